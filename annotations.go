@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Replica set annotations written to every selected pod when ANNOTATE_PODS is
+// enabled. roleChangedAtAnnotation is only updated on the pods whose role
+// labels the labeler actually changes.
+const (
+	setNameAnnotation       = "mongo-labeler/set-name"
+	setVersionAnnotation    = "mongo-labeler/set-version"
+	electionIDAnnotation    = "mongo-labeler/election-id"
+	termAnnotation          = "mongo-labeler/term"
+	roleChangedAtAnnotation = "mongo-labeler/role-changed-at"
+)
+
+// parseReplicaSetInfo copies the replica set metadata of a "hello" response
+// into top. electionId is only reported by the primary, and the term is taken
+// from lastWrite.opTime.t, so either may be left unset.
+func parseReplicaSetInfo(hello bson.M, top *topology) {
+	top.SetName, _ = hello["setName"].(string)
+	top.SetVersion, _ = bsonInt64(hello["setVersion"])
+	top.ElectionID, _ = hello["electionId"].(bson.ObjectID)
+	opTime := bsonDocument(bsonDocument(hello["lastWrite"])["opTime"])
+	if term, ok := bsonInt64(opTime["t"]); ok {
+		top.Term = term
+	}
+}
+
+// desiredAnnotations returns the replica set annotations every pod should
+// carry for top. Values the responding node did not report are left out, so
+// the previous annotation is kept rather than removed. This matters most for
+// the election ID, which only the primary reports: removing it from the other
+// sidecars would undo the primary's sidecar on every reconcile and lower the
+// ELECTION_FENCING fence it raises.
+func (l *Labeler) desiredAnnotations(top *topology) map[string]any {
+	annotations := map[string]any{}
+	if !l.Config.AnnotatePods {
+		return annotations
+	}
+	if top.SetName != "" {
+		annotations[setNameAnnotation] = top.SetName
+	}
+	if top.SetVersion != 0 {
+		annotations[setVersionAnnotation] = strconv.FormatInt(top.SetVersion, 10)
+	}
+	if !top.ElectionID.IsZero() {
+		annotations[electionIDAnnotation] = top.ElectionID.Hex()
+	}
+	if top.Term != 0 {
+		annotations[termAnnotation] = strconv.FormatInt(top.Term, 10)
+	}
+	return annotations
+}
+
+// roleChanged reports whether label changes touch a role label: the primary
+// label (including its removal) or mongo-role.
+func (l *Labeler) roleChanged(labels map[string]any) bool {
+	for _, key := range []string{l.Config.PrimaryLabel.Key, roleLabel} {
+		if _, ok := labels[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// roleChangedAt formats now for roleChangedAtAnnotation.
+func roleChangedAt(now time.Time) string {
+	return now.UTC().Format(time.RFC3339)
+}
+
+// bsonDocument returns an embedded document of a command response as a map.
+// The driver decodes nested documents as bson.D unless told otherwise.
+func bsonDocument(value any) bson.M {
+	switch v := value.(type) {
+	case bson.M:
+		return v
+	case map[string]any:
+		return v
+	case bson.D:
+		doc := make(bson.M, len(v))
+		for _, e := range v {
+			doc[e.Key] = e.Value
+		}
+		return doc
+	}
+	return nil
+}
+
+// bsonInt64 converts a numeric command response field to int64.
+func bsonInt64(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestParseReplicaSetInfo(t *testing.T) {
+	electionID, err := bson.ObjectIDFromHex("7fffffff0000000000000003")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		hello bson.M
+		want  topology
+	}{
+		{
+			name: "primary response",
+			hello: bson.M{
+				"setName":    "rs0",
+				"setVersion": int32(4),
+				"electionId": electionID,
+				"lastWrite": bson.D{
+					{Key: "opTime", Value: bson.D{
+						{Key: "ts", Value: bson.Timestamp{T: 1700000000, I: 1}},
+						{Key: "t", Value: int64(3)},
+					}},
+				},
+			},
+			want: topology{SetName: "rs0", SetVersion: 4, ElectionID: electionID, Term: 3},
+		},
+		{
+			name: "secondary response without electionId",
+			hello: bson.M{
+				"setName":    "rs0",
+				"setVersion": int32(4),
+				"lastWrite":  bson.M{"opTime": bson.M{"t": int64(3)}},
+			},
+			want: topology{SetName: "rs0", SetVersion: 4, Term: 3},
+		},
+		{
+			name:  "standalone response",
+			hello: bson.M{"isWritablePrimary": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got topology
+			parseReplicaSetInfo(tt.hello, &got)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSetPrimaryLabel_AnnotatesPods(t *testing.T) {
+	electionID, err := bson.ObjectIDFromHex("7fffffff0000000000000003")
+	require.NoError(t, err)
+
+	k8sClient := newClientsetWithPrimary("default", map[string]string{
+		"mongo-0": "true",
+		"mongo-1": "false",
+	})
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+	labeler.Config.AnnotatePods = true
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-1", SetName: "rs0", SetVersion: 4, ElectionID: electionID, Term: 3}, nil
+	}
+
+	require.NoError(t, labeler.setPrimaryLabel())
+	_, annotations := podMetadata(t, k8sClient)
+	for _, pod := range []string{"mongo-0", "mongo-1"} {
+		assert.Equal(t, "rs0", annotations[pod][setNameAnnotation], pod)
+		assert.Equal(t, "4", annotations[pod][setVersionAnnotation], pod)
+		assert.Equal(t, "7fffffff0000000000000003", annotations[pod][electionIDAnnotation], pod)
+		assert.Equal(t, "3", annotations[pod][termAnnotation], pod)
+
+		changedAt, err := time.Parse(time.RFC3339, annotations[pod][roleChangedAtAnnotation])
+		require.NoError(t, err, pod)
+		assert.WithinDuration(t, time.Now(), changedAt, 2*time.Second, pod)
+	}
+
+	// A new term updates every pod, but without a role change the
+	// role-changed-at timestamp is left alone.
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-1", SetName: "rs0", SetVersion: 4, Term: 4}, nil
+	}
+	k8sClient.ClearActions()
+	require.NoError(t, labeler.setPrimaryLabel())
+	assert.Len(t, k8sClient.Actions(), 3, "one list and one patch per pod")
+	_, updated := podMetadata(t, k8sClient)
+	for _, pod := range []string{"mongo-0", "mongo-1"} {
+		assert.Equal(t, "4", updated[pod][termAnnotation], pod)
+		assert.Equal(t, "7fffffff0000000000000003", updated[pod][electionIDAnnotation], "an unreported election id is kept")
+		assert.Equal(t, annotations[pod][roleChangedAtAnnotation], updated[pod][roleChangedAtAnnotation], pod)
+	}
+}
+
+func TestSetPrimaryLabel_NoAnnotationsByDefault(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-1", SetName: "rs0", Term: 3}, nil
+	}
+
+	require.NoError(t, labeler.setPrimaryLabel())
+	_, annotations := podMetadata(t, k8sClient)
+	for pod, podAnnotations := range annotations {
+		assert.Empty(t, podAnnotations, pod)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// defaultFieldManager names the labeler in managedFields.
+const defaultFieldManager = eventComponent
+
+// maxFieldManagerLength is the longest fieldManager the API server accepts.
+const maxFieldManagerLength = 128
+
+// getFieldManagerFromEnvironment reads FIELD_MANAGER, which the API server
+// only accepts when short and printable.
+func getFieldManagerFromEnvironment() (string, error) {
+	fieldManager := envString("FIELD_MANAGER", defaultFieldManager)
+	if fieldManager == "" || len(fieldManager) > maxFieldManagerLength || strings.ContainsFunc(fieldManager, func(r rune) bool { return !unicode.IsPrint(r) }) {
+		return "", fmt.Errorf("invalid FIELD_MANAGER value %q: must be 1 to %d printable characters", fieldManager, maxFieldManagerLength)
+	}
+	return fieldManager, nil
+}
+
+// applyPrimaryLabel is patchPrimaryLabel with SERVER_SIDE_APPLY. An apply
+// request declares every field its manager owns, so the labels and annotations
+// FIELD_MANAGER already applied to pod are sent again with their current value,
+// and the changes on top; no apply is sent when that would change nothing.
+// A removed key is left out of the apply, which gives up its ownership, and
+// then deleted with a strategic-merge patch, as leaving it out does not delete
+// a key that another manager, or the labeler before SERVER_SIDE_APPLY, also
+// set.
+func (l *Labeler) applyPrimaryLabel(pod *corev1.Pod, labels, annotations map[string]any) error {
+	ownedLabels, ownedAnnotations := appliedMetadataKeys(pod, l.Config.FieldManager)
+	appliedLabels, setLabels, removedLabels := appliedValues(pod.Labels, ownedLabels, labels)
+	appliedAnnotations, setAnnotations, removedAnnotations := appliedValues(pod.Annotations, ownedAnnotations, annotations)
+
+	metadata := map[string]any{
+		"name":      pod.GetName(),
+		"namespace": l.Config.Namespace,
+	}
+	if pod.GetResourceVersion() != "" {
+		metadata["resourceVersion"] = pod.GetResourceVersion()
+	}
+	if len(appliedLabels) > 0 {
+		metadata["labels"] = appliedLabels
+	}
+	if len(appliedAnnotations) > 0 {
+		metadata["annotations"] = appliedAnnotations
+	}
+	applyConfig := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   metadata,
+	}
+	if len(setLabels) > 0 || len(setAnnotations) > 0 || ownsAny(ownedLabels, removedLabels) || ownsAny(ownedAnnotations, removedAnnotations) {
+		applied, err := l.sendPatch(pod, types.ApplyPatchType, applyConfig, setLabels, setAnnotations)
+		if err != nil {
+			return err
+		}
+		// The removal is conditional on the pod as applied.
+		pod = applied
+	}
+
+	if len(removedLabels) == 0 && len(removedAnnotations) == 0 {
+		return nil
+	}
+	_, err := l.sendPatch(pod, types.StrategicMergePatchType, primaryLabelPatch(pod.GetResourceVersion(), removedLabels, removedAnnotations), removedLabels, removedAnnotations)
+	return err
+}
+
+// appliedValues splits changes to current into the full set of values to
+// apply (the owned keys at their current value, then the changes), the
+// changes that set a value and those that remove one.
+func appliedValues(current map[string]string, owned map[string]bool, changes map[string]any) (applied, set, removed map[string]any) {
+	applied, set, removed = map[string]any{}, map[string]any{}, map[string]any{}
+	for key := range owned {
+		if value, ok := current[key]; ok {
+			applied[key] = value
+		}
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(applied, key)
+			removed[key] = nil
+			continue
+		}
+		applied[key] = value
+		set[key] = value
+	}
+	return applied, set, removed
+}
+
+// ownsAny reports whether any of keys is owned.
+func ownsAny(owned map[string]bool, keys map[string]any) bool {
+	for key := range keys {
+		if owned[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// appliedMetadataKeys returns the label and annotation keys of pod that
+// fieldManager owns through server-side apply, read from managedFields.
+func appliedMetadataKeys(pod *corev1.Pod, fieldManager string) (labels, annotations map[string]bool) {
+	labels, annotations = map[string]bool{}, map[string]bool{}
+	for _, entry := range pod.ManagedFields {
+		if entry.Manager != fieldManager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.Subresource != "" || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields struct {
+			Metadata struct {
+				Labels      map[string]json.RawMessage `json:"f:labels"`
+				Annotations map[string]json.RawMessage `json:"f:annotations"`
+			} `json:"f:metadata"`
+		}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		for field := range fields.Metadata.Labels {
+			if key, ok := strings.CutPrefix(field, "f:"); ok {
+				labels[key] = true
+			}
+		}
+		for field := range fields.Metadata.Annotations {
+			if key, ok := strings.CutPrefix(field, "f:"); ok {
+				annotations[key] = true
+			}
+		}
+	}
+	return labels, annotations
+}
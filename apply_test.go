@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestGetFieldManagerFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr string
+	}{
+		{name: "default", env: map[string]string{}, want: defaultFieldManager},
+		{name: "custom", env: map[string]string{"FIELD_MANAGER": "mongo-operator"}, want: "mongo-operator"},
+		{name: "empty", env: map[string]string{"FIELD_MANAGER": ""}, wantErr: "invalid FIELD_MANAGER value"},
+		{name: "not printable", env: map[string]string{"FIELD_MANAGER": "mongo\tlabeler"}, wantErr: "invalid FIELD_MANAGER value"},
+		{
+			name:    "too long",
+			env:     map[string]string{"FIELD_MANAGER": strings.Repeat("m", maxFieldManagerLength+1)},
+			wantErr: "must be 1 to 128 printable characters",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfigEnv(t, tt.env)
+			fieldManager, err := getFieldManagerFromEnvironment()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, fieldManager)
+		})
+	}
+}
+
+func TestSetPrimaryLabel_ServerSideApply(t *testing.T) {
+	k8sClient := newClientsetWithPrimary("default", map[string]string{"mongo-0": "true", "mongo-1": ""})
+	labeler := newTestLabeler(k8sClient, false, "mongo-1")
+	labeler.Config.ServerSideApply = true
+	labeler.Config.FieldManager = defaultFieldManager
+	labeler.Config.ForceConflicts = true
+
+	require.NoError(t, labeler.setPrimaryLabel())
+
+	pods := map[string]*corev1.Pod{}
+	for _, name := range []string{"mongo-0", "mongo-1"} {
+		pod, err := k8sClient.Tracker().Get(corev1.SchemeGroupVersion.WithResource("pods"), "default", name)
+		require.NoError(t, err)
+		typed, ok := pod.(*corev1.Pod)
+		require.True(t, ok, "unexpected object %T", pod)
+		pods[name] = typed
+	}
+	assert.NotContains(t, pods["mongo-0"].Labels, "primary", "the label set before SERVER_SIDE_APPLY is removed")
+	assert.Equal(t, "true", pods["mongo-1"].Labels["primary"])
+	owned, _ := appliedMetadataKeys(pods["mongo-1"], defaultFieldManager)
+	assert.Equal(t, map[string]bool{"primary": true}, owned)
+
+	var patchTypes []types.PatchType
+	for _, action := range k8sClient.Actions() {
+		patchAction, ok := action.(k8stesting.PatchActionImpl)
+		if !ok {
+			continue
+		}
+		patchTypes = append(patchTypes, patchAction.GetPatchType())
+		if patchAction.GetPatchType() == types.ApplyPatchType {
+			opts := patchAction.PatchOptions
+			assert.Equal(t, defaultFieldManager, opts.FieldManager)
+			require.NotNil(t, opts.Force)
+			assert.True(t, *opts.Force)
+		}
+	}
+	assert.Equal(t, []types.PatchType{types.StrategicMergePatchType, types.ApplyPatchType}, patchTypes, "nothing to apply to mongo-0")
+}
+
+func TestAppliedValues(t *testing.T) {
+	current := map[string]string{"primary": "true", "mongo-role": "primary", "app": "mongo"}
+	owned := map[string]bool{"primary": true, "mongo-role": true}
+
+	applied, set, removed := appliedValues(current, owned, map[string]any{"primary": nil, "mongo-role": "secondary"})
+
+	assert.Equal(t, map[string]any{"mongo-role": "secondary"}, applied, "keys owned by others are never applied")
+	assert.Equal(t, map[string]any{"mongo-role": "secondary"}, set)
+	assert.Equal(t, map[string]any{"primary": nil}, removed)
+}
+
+func TestAppliedMetadataKeys(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{ManagedFields: []metav1.ManagedFieldsEntry{
+		{
+			Manager:   defaultFieldManager,
+			Operation: metav1.ManagedFieldsOperationApply,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:primary":{}},"f:annotations":{"f:mongo-labeler/term":{}}}}`)},
+		},
+		{
+			Manager:   defaultFieldManager,
+			Operation: metav1.ManagedFieldsOperationUpdate,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:mongo-role":{}}}}`)},
+		},
+		{
+			Manager:   "argocd-controller",
+			Operation: metav1.ManagedFieldsOperationApply,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:app":{}}}}`)},
+		},
+	}}}
+
+	labels, annotations := appliedMetadataKeys(pod, defaultFieldManager)
+	assert.Equal(t, map[string]bool{"primary": true}, labels)
+	assert.Equal(t, map[string]bool{"mongo-labeler/term": true}, annotations)
+}
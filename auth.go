@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Supported MONGO_AUTH_MECHANISM values. An empty mechanism with a username
+// lets the driver negotiate SCRAM with the server.
+const (
+	authMechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	authMechanismSCRAMSHA1   = "SCRAM-SHA-1"
+	authMechanismX509        = "MONGODB-X509"
+)
+
+// secret holds a credential that must never reach the logs. Its String and
+// MarshalText methods redact the value, so it is safe inside a logged Config.
+type secret string
+
+const redacted = "[REDACTED]"
+
+func (s secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// redactURI returns a MongoDB connection string with only the password of its
+// userinfo redacted, so the hosts and options can still be read. A string that
+// is not a URI is redacted whole.
+func redactURI(uri secret) string {
+	scheme, rest, ok := strings.Cut(string(uri), "://")
+	if !ok {
+		return uri.String()
+	}
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	at := strings.LastIndex(rest[:end], "@")
+	if at < 0 {
+		return string(uri)
+	}
+	username, _, hasPassword := strings.Cut(rest[:at], ":")
+	if !hasPassword {
+		return string(uri)
+	}
+	return scheme + "://" + username + ":" + redacted + rest[at:]
+}
+
+// MongoAuth is the optional MongoDB authentication configuration.
+type MongoAuth struct {
+	Username  string
+	Password  secret
+	Source    string
+	Mechanism string
+}
+
+// getMongoAuthFromEnvironment reads MONGO_USERNAME, MONGO_PASSWORD (or their
+// *_FILE variants pointing at mounted secret files), MONGO_AUTH_SOURCE and
+// MONGO_AUTH_MECHANISM, and validates the combination.
+func getMongoAuthFromEnvironment() (MongoAuth, error) {
+	username, err := envSecretString("MONGO_USERNAME")
+	if err != nil {
+		return MongoAuth{}, err
+	}
+	password, err := envSecretString("MONGO_PASSWORD")
+	if err != nil {
+		return MongoAuth{}, err
+	}
+	auth := MongoAuth{
+		Username:  username,
+		Password:  secret(password),
+		Source:    envString("MONGO_AUTH_SOURCE", ""),
+		Mechanism: strings.ToUpper(envString("MONGO_AUTH_MECHANISM", "")),
+	}
+	if err := auth.validate(); err != nil {
+		return MongoAuth{}, err
+	}
+	return auth, nil
+}
+
+// validate rejects unknown mechanisms and credential combinations the
+// mechanism cannot use, so a misconfigured sidecar fails at startup rather than
+// on every reconcile.
+func (a MongoAuth) validate() error {
+	switch a.Mechanism {
+	case "", authMechanismSCRAMSHA256, authMechanismSCRAMSHA1:
+		if a.Password != "" && a.Username == "" {
+			return fmt.Errorf("MONGO_PASSWORD requires MONGO_USERNAME")
+		}
+		if a.Mechanism != "" && (a.Username == "" || a.Password == "") {
+			return fmt.Errorf("MONGO_AUTH_MECHANISM %s requires MONGO_USERNAME and MONGO_PASSWORD", a.Mechanism)
+		}
+	case authMechanismX509:
+		// The username, if given, must match the client certificate subject.
+		if a.Password != "" {
+			return fmt.Errorf("MONGO_AUTH_MECHANISM %s does not use MONGO_PASSWORD", a.Mechanism)
+		}
+	default:
+		return fmt.Errorf(
+			"invalid MONGO_AUTH_MECHANISM value %q: must be one of %s, %s or %s",
+			a.Mechanism,
+			authMechanismSCRAMSHA256,
+			authMechanismSCRAMSHA1,
+			authMechanismX509,
+		)
+	}
+	return nil
+}
+
+// enabled reports whether the sidecar should authenticate at all.
+func (a MongoAuth) enabled() bool {
+	return a.Username != "" || a.Mechanism != ""
+}
+
+// credential converts the configuration into driver options. An empty Source
+// leaves the driver default in place: "admin" for SCRAM, "$external" for x509.
+func (a MongoAuth) credential() options.Credential {
+	return options.Credential{
+		AuthMechanism: a.Mechanism,
+		AuthSource:    a.Source,
+		Username:      a.Username,
+		Password:      string(a.Password),
+		PasswordSet:   a.Password != "",
+	}
+}
+
+// envSecretString returns the value of key, or the contents of the file named
+// by key_FILE (trailing newline removed) for Kubernetes Secret volume mounts.
+// Setting both is ambiguous and rejected.
+func envSecretString(key string) (string, error) {
+	fileKey := key + "_FILE"
+	value, hasValue := os.LookupEnv(key)
+	path, hasFile := os.LookupEnv(fileKey)
+	switch {
+	case hasValue && hasFile:
+		return "", fmt.Errorf("set only one of %s and %s", key, fileKey)
+	case hasFile:
+		content, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+		if err != nil {
+			return "", fmt.Errorf("read %s %q: %w", fileKey, path, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestGetMongoAuthFromEnvironment(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("s3cret\n"), 0o600))
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		want        MongoAuth
+		errContains string
+	}{
+		{
+			name: "no auth",
+			env:  map[string]string{},
+			want: MongoAuth{},
+		},
+		{
+			name: "scram from env",
+			env: map[string]string{
+				"MONGO_USERNAME":       "labeler",
+				"MONGO_PASSWORD":       "s3cret",
+				"MONGO_AUTH_SOURCE":    "admin",
+				"MONGO_AUTH_MECHANISM": "scram-sha-256",
+			},
+			want: MongoAuth{Username: "labeler", Password: "s3cret", Source: "admin", Mechanism: authMechanismSCRAMSHA256},
+		},
+		{
+			name: "password from mounted secret file",
+			env: map[string]string{
+				"MONGO_USERNAME":      "labeler",
+				"MONGO_PASSWORD_FILE": passwordFile,
+			},
+			want: MongoAuth{Username: "labeler", Password: "s3cret"},
+		},
+		{
+			name: "x509 without username",
+			env:  map[string]string{"MONGO_AUTH_MECHANISM": "MONGODB-X509"},
+			want: MongoAuth{Mechanism: authMechanismX509},
+		},
+		{
+			name: "both password and password file",
+			env: map[string]string{
+				"MONGO_USERNAME":      "labeler",
+				"MONGO_PASSWORD":      "s3cret",
+				"MONGO_PASSWORD_FILE": passwordFile,
+			},
+			errContains: "set only one of MONGO_PASSWORD and MONGO_PASSWORD_FILE",
+		},
+		{
+			name:        "missing password file",
+			env:         map[string]string{"MONGO_PASSWORD_FILE": filepath.Join(t.TempDir(), "missing")},
+			errContains: "read MONGO_PASSWORD_FILE",
+		},
+		{
+			name:        "password without username",
+			env:         map[string]string{"MONGO_PASSWORD": "s3cret"},
+			errContains: "MONGO_PASSWORD requires MONGO_USERNAME",
+		},
+		{
+			name:        "scram mechanism without password",
+			env:         map[string]string{"MONGO_USERNAME": "labeler", "MONGO_AUTH_MECHANISM": "SCRAM-SHA-256"},
+			errContains: "requires MONGO_USERNAME and MONGO_PASSWORD",
+		},
+		{
+			name: "x509 with password",
+			env: map[string]string{
+				"MONGO_USERNAME":       "CN=labeler",
+				"MONGO_PASSWORD":       "s3cret",
+				"MONGO_AUTH_MECHANISM": "MONGODB-X509",
+			},
+			errContains: "does not use MONGO_PASSWORD",
+		},
+		{
+			name:        "unknown mechanism",
+			env:         map[string]string{"MONGO_AUTH_MECHANISM": "PLAIN"},
+			errContains: "invalid MONGO_AUTH_MECHANISM value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfigEnv(t, tt.env)
+
+			got, err := getMongoAuthFromEnvironment()
+			if tt.errContains != "" {
+				require.ErrorContains(t, err, tt.errContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMongoAuthCredential(t *testing.T) {
+	auth := MongoAuth{Username: "labeler", Password: "s3cret", Mechanism: authMechanismSCRAMSHA256}
+	assert.True(t, auth.enabled())
+	assert.Equal(t, options.Credential{
+		AuthMechanism: authMechanismSCRAMSHA256,
+		Username:      "labeler",
+		Password:      "s3cret",
+		PasswordSet:   true,
+	}, auth.credential())
+
+	assert.False(t, MongoAuth{}.enabled())
+}
+
+func TestSecretIsRedacted(t *testing.T) {
+	password := secret("s3cret")
+	assert.Equal(t, redacted, password.String())
+	assert.Equal(t, redacted, fmt.Sprint(password))
+
+	encoded, err := json.Marshal(MongoAuth{Username: "labeler", Password: password})
+	require.NoError(t, err)
+	assert.NotContains(t, string(encoded), "s3cret")
+
+	assert.Empty(t, secret("").String())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// maxReconcileBackoff caps the delay between retries of a failing
+	// reconcile, before jitter.
+	maxReconcileBackoff = 2 * time.Minute
+	// reconcileBackoffJitter adds up to this fraction of the delay to every
+	// retry, so sidecars that failed together do not all retry together once
+	// MongoDB or the apiserver is back.
+	reconcileBackoffJitter = 0.5
+	// errorLogInterval is how often a reconcile error that keeps repeating is
+	// logged at error level.
+	errorLogInterval = time.Minute
+)
+
+// newReconcileBackoff returns the retry delays of a failing reconcile: base,
+// then doubling up to maxReconcileBackoff, each with jitter. It is started
+// afresh after every successful reconcile. wait.Backoff only caps the delays
+// after the first, so base is capped here.
+func newReconcileBackoff(base time.Duration) *wait.Backoff {
+	return &wait.Backoff{
+		Duration: min(base, maxReconcileBackoff),
+		Factor:   2,
+		Jitter:   reconcileBackoffJitter,
+		Steps:    math.MaxInt32,
+		Cap:      maxReconcileBackoff,
+	}
+}
+
+// errorLogLimiter rate limits the logging of reconcile errors: an error is
+// logged when it differs from the last one logged, or when that one was logged
+// at least interval ago, and is counted as suppressed otherwise.
+type errorLogLimiter struct {
+	interval    time.Duration
+	lastLogged  time.Time
+	lastMessage string
+	suppressed  int
+}
+
+// allow reports whether err should be logged at now, and if so how many
+// errors were suppressed since the last one logged.
+func (r *errorLogLimiter) allow(err error, now time.Time) (int, bool) {
+	if err.Error() == r.lastMessage && now.Sub(r.lastLogged) < r.interval {
+		r.suppressed++
+		return 0, false
+	}
+	suppressed := r.suppressed
+	r.lastLogged, r.lastMessage, r.suppressed = now, err.Error(), 0
+	return suppressed, true
+}
+
+// reset forgets the last error once a reconcile succeeds, returning how many
+// errors were suppressed since the last one logged.
+func (r *errorLogLimiter) reset() int {
+	suppressed := r.suppressed
+	*r = errorLogLimiter{interval: r.interval}
+	return suppressed
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReconcileBackoff(t *testing.T) {
+	backoff := newReconcileBackoff(5 * time.Second)
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, maxReconcileBackoff, maxReconcileBackoff}
+	for i, base := range want {
+		delay := backoff.Step()
+		assert.GreaterOrEqual(t, delay, base, "retry %d", i)
+		assert.LessOrEqual(t, delay, time.Duration(float64(base)*(1+reconcileBackoffJitter)), "retry %d", i)
+	}
+}
+
+func TestNewReconcileBackoff_CapsBase(t *testing.T) {
+	backoff := newReconcileBackoff(10 * time.Minute)
+	for i := range 3 {
+		delay := backoff.Step()
+		assert.GreaterOrEqual(t, delay, maxReconcileBackoff, "retry %d", i)
+		assert.LessOrEqual(t, delay, time.Duration(float64(maxReconcileBackoff)*(1+reconcileBackoffJitter)), "retry %d", i)
+	}
+}
+
+func TestErrorLogLimiter(t *testing.T) {
+	limiter := &errorLogLimiter{interval: time.Minute}
+	start := time.Now()
+	mongoDown := errors.New("mongo down")
+
+	suppressed, ok := limiter.allow(mongoDown, start)
+	assert.True(t, ok, "the first error is logged")
+	assert.Zero(t, suppressed)
+
+	_, ok = limiter.allow(mongoDown, start.Add(10*time.Second))
+	assert.False(t, ok)
+	_, ok = limiter.allow(mongoDown, start.Add(20*time.Second))
+	assert.False(t, ok)
+
+	suppressed, ok = limiter.allow(errors.New("forbidden"), start.Add(30*time.Second))
+	assert.True(t, ok, "a different error is logged at once")
+	assert.Equal(t, 2, suppressed)
+
+	_, ok = limiter.allow(errors.New("forbidden"), start.Add(40*time.Second))
+	assert.False(t, ok)
+	suppressed, ok = limiter.allow(errors.New("forbidden"), start.Add(90*time.Second))
+	assert.True(t, ok, "a repeated error is logged again after the interval")
+	assert.Equal(t, 1, suppressed)
+
+	_, ok = limiter.allow(mongoDown, start.Add(100*time.Second))
+	assert.True(t, ok)
+	_, ok = limiter.allow(mongoDown, start.Add(110*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 1, limiter.reset())
+	_, ok = limiter.allow(mongoDown, start.Add(120*time.Second))
+	assert.True(t, ok, "the next failure after a success is logged")
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	phuslog "github.com/phuslu/log"
+	"sigs.k8s.io/yaml"
+)
+
+// settings lists every environment variable the configuration is read from.
+// Each one can also be set by its camelCase key in the --config file
+// (MONGO_TLS_CA_FILE is mongoTlsCaFile) and by its kebab-case flag
+// (--mongo-tls-ca-file). The environment overrides the file, and flags
+// override both.
+var settings = []setting{
+	{env: "LABEL_SELECTOR"},
+	{env: "NAMESPACE"},
+	{env: "MONGO_URI", alternatives: []string{"MONGO_ADDRESS"}},
+	{env: "MONGO_ADDRESS", alternatives: []string{"MONGO_URI"}},
+	{env: "MONGO_USERNAME", alternatives: []string{"MONGO_USERNAME_FILE"}},
+	{env: "MONGO_USERNAME_FILE", alternatives: []string{"MONGO_USERNAME"}},
+	{env: "MONGO_PASSWORD", alternatives: []string{"MONGO_PASSWORD_FILE"}},
+	{env: "MONGO_PASSWORD_FILE", alternatives: []string{"MONGO_PASSWORD"}},
+	{env: "MONGO_AUTH_SOURCE"},
+	{env: "MONGO_AUTH_MECHANISM"},
+	{env: "MONGO_TLS", boolean: true},
+	{env: "MONGO_TLS_CA_FILE"},
+	{env: "MONGO_TLS_CERT_FILE"},
+	{env: "MONGO_TLS_KEY_FILE"},
+	{env: "MONGO_TLS_INSECURE_SKIP_VERIFY", boolean: true},
+	{env: "PRIMARY_LABEL_KEY"},
+	{env: "PRIMARY_LABEL_VALUE"},
+	{env: "NON_PRIMARY_LABEL_VALUE"},
+	{env: "HOST_MAPPING"},
+	{env: "HOST_MAPPING_REGEX"},
+	{env: "HOST_MAPPING_TEMPLATE"},
+	{env: "NO_PRIMARY_POLICY"},
+	{env: "NO_PRIMARY_GRACE_PERIOD"},
+	{env: "LABEL_ALL", boolean: true},
+	{env: "LABEL_ROLES", boolean: true},
+	{env: "SHARDED", boolean: true},
+	{env: "QUORUM_CHECK", boolean: true},
+	{env: "ELECTION_FENCING", boolean: true},
+	{env: "ANNOTATE_PODS", boolean: true},
+	{env: "REPLICATION_LAG_THRESHOLD"},
+	{env: "WATCH_TOPOLOGY", boolean: true},
+	{env: "RECONCILE_INTERVAL"},
+	{env: "MONGO_COMMAND_TIMEOUT"},
+	{env: "DRY_RUN", boolean: true},
+	{env: "SERVER_SIDE_APPLY", boolean: true},
+	{env: "FIELD_MANAGER"},
+	{env: "FORCE_CONFLICTS", boolean: true},
+	{env: "LEADER_ELECTION_LEASE_NAME"},
+	{env: "LISTEN_ADDRESS"},
+	{env: "READINESS_FAILURE_THRESHOLD"},
+	{env: "READINESS_MAX_STALENESS"},
+	{env: "K8S_REQUEST_TIMEOUT"},
+	{env: "REPLICA_SETS_FILE"},
+	{env: "DEBUG", boolean: true},
+}
+
+// setting is one environment variable of the configuration. Alternatives are
+// the variables that must not be set together with it, such as MONGO_URI and
+// MONGO_ADDRESS: setting one of them in a higher layer discards the others
+// from the lower ones, so an env MONGO_URI overrides a file mongoAddress.
+type setting struct {
+	env          string
+	boolean      bool
+	alternatives []string
+}
+
+// key returns the name of the setting in the --config file.
+func (s setting) key() string {
+	var key strings.Builder
+	for i, word := range strings.Split(strings.ToLower(s.env), "_") {
+		if i > 0 {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		key.WriteString(word)
+	}
+	return key.String()
+}
+
+// flag returns the name of the command-line flag of the setting.
+func (s setting) flag() string {
+	return strings.ReplaceAll(strings.ToLower(s.env), "_", "-")
+}
+
+// commandLine holds the parsed command-line flags. Settings maps the
+// environment variable of every setting flag given to its value.
+type commandLine struct {
+	kubeconfig  string
+	configFile  string
+	printConfig bool
+	settings    map[string]string
+}
+
+// newFlagSet returns a flag set that parses into cmd. It is local rather than
+// flag.CommandLine so it is safe to parse more than once.
+func newFlagSet(cmd *commandLine, defaultKubeconfig string) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&cmd.kubeconfig, "kubeconfig", defaultKubeconfig, "(optional) absolute path to the kubeconfig file")
+	fs.StringVar(&cmd.configFile, "config", "", "YAML or JSON config file, overridden by the environment and flags")
+	fs.BoolVar(&cmd.printConfig, "print-config", false, "print the effective configuration, with secrets redacted, and exit")
+	for _, s := range settings {
+		fs.Var(settingValue{setting: s, values: cmd.settings}, s.flag(), "overrides "+s.env)
+	}
+	return fs
+}
+
+// parseCommandLine parses the process arguments. A malformed invocation (an
+// unknown flag, a flag without a value or a stray argument) returns an error
+// so the sidecar fails fast rather than silently ignoring it.
+func parseCommandLine(args []string, defaultKubeconfig string) (*commandLine, error) {
+	cmd := &commandLine{settings: map[string]string{}}
+	fs := newFlagSet(cmd, defaultKubeconfig)
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("parse command-line flags: %w", err)
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("parse command-line flags: unexpected argument %q", fs.Arg(0))
+	}
+	return cmd, nil
+}
+
+// printUsage writes the command-line flags to w.
+func printUsage(w io.Writer) {
+	fs := newFlagSet(&commandLine{settings: map[string]string{}}, "")
+	fs.SetOutput(w)
+	fmt.Fprintf(w, "Usage of %s:\n", fs.Name())
+	fs.PrintDefaults()
+}
+
+// settingValue is the flag.Value of a setting flag. Boolean settings can be
+// given without a value, like --dry-run.
+type settingValue struct {
+	setting
+	values map[string]string
+}
+
+func (v settingValue) String() string {
+	return v.values[v.env]
+}
+
+func (v settingValue) Set(value string) error {
+	if v.boolean {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return err
+		}
+	}
+	v.values[v.env] = value
+	return nil
+}
+
+func (v settingValue) IsBoolFlag() bool {
+	return v.boolean
+}
+
+// loadConfig reads the configuration from the --config file, the environment
+// and the setting flags, in increasing order of precedence. The file and the
+// flags are layered onto the process environment, which
+// getConfigFromEnvironment then validates as usual.
+func loadConfig(cmd *commandLine) (*Config, error) {
+	var file map[string]string
+	if cmd.configFile != "" {
+		var err error
+		if file, err = loadConfigFile(cmd.configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := applySettings(file, cmd.settings); err != nil {
+		return nil, err
+	}
+	return getConfigFromEnvironment()
+}
+
+// applySettings exports the file settings that are not set in the environment,
+// then the flag settings, which replace them and their alternatives.
+func applySettings(file, flags map[string]string) error {
+	for _, s := range settings {
+		value, ok := file[s.env]
+		if !ok || isEnvSet(s.env) || slices.ContainsFunc(s.alternatives, isEnvSet) {
+			continue
+		}
+		if err := os.Setenv(s.env, value); err != nil {
+			return fmt.Errorf("set %s from the config file: %w", s.env, err)
+		}
+	}
+	for _, s := range settings {
+		value, ok := flags[s.env]
+		if !ok {
+			continue
+		}
+		for _, alternative := range s.alternatives {
+			if _, given := flags[alternative]; !given {
+				if err := os.Unsetenv(alternative); err != nil {
+					return fmt.Errorf("unset %s for --%s: %w", alternative, s.flag(), err)
+				}
+			}
+		}
+		if err := os.Setenv(s.env, value); err != nil {
+			return fmt.Errorf("set %s from --%s: %w", s.env, s.flag(), err)
+		}
+	}
+	return nil
+}
+
+// isEnvSet reports whether the environment variable key is set.
+func isEnvSet(key string) bool {
+	_, ok := os.LookupEnv(key)
+	return ok
+}
+
+// loadConfigFile reads the --config file, a YAML or JSON mapping of setting
+// keys to scalar values:
+//
+//	labelSelector: app=mongo
+//	mongoUri: mongodb://mongo-0.mongo:27017/?replicaSet=rs0
+//	labelAll: true
+//	reconcileInterval: 10s
+//
+// and returns the values by environment variable. Unknown keys are rejected so
+// a misspelt setting fails startup instead of being ignored.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %q: %w", path, err)
+	}
+	var document map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("parse config file %q: must be a mapping of settings: %w", path, err)
+	}
+
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key()] = s
+	}
+	values := make(map[string]string, len(document))
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(document)) {
+		s, ok := byKey[key]
+		if !ok {
+			errs = append(errs, unknownKeyError(path, key))
+			continue
+		}
+		value, err := configFileValue(document[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid key %q in config file %q: %w", key, path, err))
+			continue
+		}
+		values[s.env] = value
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return values, nil
+}
+
+// unknownKeyError rejects key, suggesting the setting it likely means when it
+// is spelt like an environment variable or a flag, or in another case.
+func unknownKeyError(path, key string) error {
+	normalized := strings.NewReplacer("_", "", "-", "").Replace(key)
+	for _, s := range settings {
+		if strings.EqualFold(normalized, s.key()) {
+			return fmt.Errorf("unknown key %q in config file %q, did you mean %q?", key, path, s.key())
+		}
+	}
+	return fmt.Errorf("unknown key %q in config file %q", key, path)
+}
+
+// configFileValue converts a config file value to its environment variable
+// form. Only strings, numbers and booleans are accepted.
+func configFileValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", fmt.Errorf("has no value")
+	}
+	return "", fmt.Errorf("must be a string, a number or a boolean")
+}
+
+// effectiveConfig returns the configuration as the --config file keys it was
+// read from, with passwords redacted, so that the output of --print-config
+// can be diffed across environments. The *_FILE settings are shown as the
+// values read from their files, and REPLICA_SETS_FILE as its replicaSets.
+func (c *Config) effectiveConfig() map[string]any {
+	config := map[string]any{
+		"labelSelector":              c.LabelSelector,
+		"namespace":                  c.Namespace,
+		"mongoUsername":              c.MongoAuth.Username,
+		"mongoPassword":              c.MongoAuth.Password,
+		"mongoAuthSource":            c.MongoAuth.Source,
+		"mongoAuthMechanism":         c.MongoAuth.Mechanism,
+		"mongoTls":                   c.MongoTLS.Enabled,
+		"mongoTlsCaFile":             c.MongoTLS.CAFile,
+		"mongoTlsCertFile":           c.MongoTLS.CertFile,
+		"mongoTlsKeyFile":            c.MongoTLS.KeyFile,
+		"mongoTlsInsecureSkipVerify": c.MongoTLS.InsecureSkipVerify,
+		"primaryLabelKey":            c.PrimaryLabel.Key,
+		"primaryLabelValue":          c.PrimaryLabel.Value,
+		"nonPrimaryLabelValue":       c.PrimaryLabel.NonPrimaryValue,
+		"hostMapping":                c.HostMapping.Strategy,
+		"noPrimaryPolicy":            c.NoPrimaryPolicy,
+		"noPrimaryGracePeriod":       c.NoPrimaryGracePeriod.String(),
+		"labelAll":                   c.LabelAll,
+		"labelRoles":                 c.LabelRoles,
+		"sharded":                    c.Sharded,
+		"quorumCheck":                c.QuorumCheck,
+		"electionFencing":            c.ElectionFencing,
+		"annotatePods":               c.AnnotatePods,
+		"replicationLagThreshold":    c.ReplicationLagThreshold.String(),
+		"watchTopology":              c.WatchTopology,
+		"reconcileInterval":          c.ReconcileInterval.String(),
+		"mongoCommandTimeout":        c.MongoCommandTimeout.String(),
+		"dryRun":                     c.DryRun,
+		"serverSideApply":            c.ServerSideApply,
+		"fieldManager":               c.FieldManager,
+		"forceConflicts":             c.ForceConflicts,
+		"leaderElectionLeaseName":    c.LeaderElectionLeaseName,
+		"listenAddress":              c.ListenAddress,
+		"readinessFailureThreshold":  c.ReadinessFailureThreshold,
+		"readinessMaxStaleness":      c.ReadinessMaxStaleness.String(),
+		"k8sRequestTimeout":          c.K8sRequestTimeout.String(),
+		"debug":                      c.LogLevel == phuslog.DebugLevel,
+	}
+	if c.URI != "" {
+		config["mongoUri"] = redactURI(c.URI)
+	} else {
+		config["mongoAddress"] = c.Address
+	}
+	if c.HostMapping.Regex != nil {
+		config["hostMappingRegex"] = c.HostMapping.Regex.String()
+	}
+	if c.HostMapping.Template != nil {
+		config["hostMappingTemplate"] = c.HostMapping.Template.Root.String()
+	}
+	if len(c.ReplicaSets) > 0 {
+		replicaSets := make([]map[string]any, len(c.ReplicaSets))
+		for i, rs := range c.ReplicaSets {
+			replicaSets[i] = map[string]any{"name": rs.Name}
+			for key, value := range map[string]string{
+				"uri":           redactURI(rs.URI),
+				"address":       rs.Address,
+				"namespace":     rs.Namespace,
+				"labelSelector": rs.LabelSelector,
+			} {
+				if value != "" {
+					replicaSets[i][key] = value
+				}
+			}
+		}
+		config["replicaSets"] = replicaSets
+	}
+	return config
+}
+
+// writeEffectiveConfig writes the effective configuration to w as YAML, with
+// the keys sorted.
+func writeEffectiveConfig(w io.Writer, c *Config) error {
+	out, err := yaml.Marshal(c.effectiveConfig())
+	if err != nil {
+		return fmt.Errorf("marshal effective configuration: %w", err)
+	}
+	_, err = w.Write(out)
+	return err
+}
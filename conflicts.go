@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	phuslog "github.com/phuslu/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// updatePod patches pod with the label and annotation changes decide returns
+// for it, if any. The patch is conditional on the resourceVersion pod was read
+// at, so a pod changed in the meantime, for example by another labeler acting
+// on an older view of the replica set, is never silently overwritten: the pod
+// is read again from the apiserver and the changes decided anew, up to
+// retry.DefaultRetry's attempts. It returns the pod the changes were decided
+// on and the label changes made, nil when there were none.
+func (l *Labeler) updatePod(pod *corev1.Pod, decide func(pod *corev1.Pod) (labels, annotations map[string]any)) (*corev1.Pod, map[string]any, error) {
+	var changes map[string]any
+	err := retry.OnError(retry.DefaultRetry, isResourceVersionConflict, func() error {
+		labels, annotations := decide(pod)
+		if len(labels) == 0 && len(annotations) == 0 {
+			changes = nil
+			return nil
+		}
+		changes = labels
+		err := l.patchPrimaryLabel(pod, labels, annotations)
+		if !isResourceVersionConflict(err) {
+			return err
+		}
+		withReplicaSet(phuslog.Info(), l.Config.Name).
+			Str("pod", pod.GetName()).
+			Str("resource_version", pod.GetResourceVersion()).
+			Msg("pod changed since it was read, reading it again")
+		current, getErr := l.getPod(pod.GetName())
+		if getErr != nil {
+			return getErr
+		}
+		pod = current
+		return err
+	})
+	return pod, changes, err
+}
+
+// isResourceVersionConflict reports whether err is a conflict on the pod's
+// resourceVersion. With SERVER_SIDE_APPLY and FORCE_CONFLICTS=false the
+// apiserver also answers a field owned by another manager with a conflict,
+// which reading the pod again cannot resolve.
+func isResourceVersionConflict(err error) bool {
+	return apierrors.IsConflict(err) && !apierrors.HasStatusCause(err, metav1.CauseTypeFieldManagerConflict)
+}
+
+// getPod reads podName from the apiserver, bypassing the informer cache that
+// may not have seen its latest change yet.
+func (l *Labeler) getPod(podName string) (*corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.Config.K8sRequestTimeout)
+	defer cancel()
+	pod, err := l.K8sClient.CoreV1().Pods(l.Config.Namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		kubernetesErrorsTotal.WithLabelValues(l.Config.Name, "get").Inc()
+		return nil, fmt.Errorf("get pod %q: %w", podName, err)
+	}
+	return pod, nil
+}
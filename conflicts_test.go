@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// patchResourceVersions returns the resourceVersion precondition of every pod
+// patch, "" for an unconditional one.
+func patchResourceVersions(t *testing.T, k8sClient *fake.Clientset) []string {
+	t.Helper()
+
+	var versions []string
+	for _, action := range k8sClient.Actions() {
+		patchAction, ok := action.(k8stesting.PatchAction)
+		if !ok {
+			continue
+		}
+		var patch struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}
+		require.NoError(t, json.Unmarshal(patchAction.GetPatch(), &patch))
+		versions = append(versions, patch.Metadata.ResourceVersion)
+	}
+	return versions
+}
+
+// conflictOnce makes the first patch of podName fail with a conflict, after
+// applying mutate to the stored pod as if another actor had changed it.
+func conflictOnce(t *testing.T, k8sClient *fake.Clientset, podName string, mutate func(pod *corev1.Pod)) {
+	t.Helper()
+
+	conflicted := false
+	k8sClient.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAction, ok := action.(k8stesting.PatchAction)
+		require.True(t, ok, "unexpected action %T", action)
+		if conflicted || patchAction.GetName() != podName {
+			return false, nil, nil
+		}
+		conflicted = true
+		gvr := corev1.SchemeGroupVersion.WithResource("pods")
+		obj, err := k8sClient.Tracker().Get(gvr, "default", podName)
+		if err != nil {
+			return true, nil, err
+		}
+		stored, ok := obj.(*corev1.Pod)
+		require.True(t, ok, "unexpected object %T", obj)
+		pod := stored.DeepCopy()
+		mutate(pod)
+		pod.ResourceVersion = "8"
+		if err := k8sClient.Tracker().Update(gvr, pod, "default"); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(gvr.GroupResource(), podName, assert.AnError)
+	})
+}
+
+func newVersionedClientset(primaryByPod map[string]string) *fake.Clientset {
+	objects := make([]runtime.Object, 0, len(primaryByPod))
+	for podName, primary := range primaryByPod {
+		objects = append(objects, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            podName,
+			Namespace:       "default",
+			ResourceVersion: "7",
+			Labels:          map[string]string{"role": "mongo", "primary": primary},
+		}})
+	}
+	return fake.NewClientset(objects...)
+}
+
+func TestSetPrimaryLabel_RetriesConflictWithFreshPod(t *testing.T) {
+	k8sClient := newVersionedClientset(map[string]string{"mongo-0": "false"})
+	conflictOnce(t, k8sClient, "mongo-0", func(pod *corev1.Pod) { pod.Labels["app"] = "mongo" })
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+	conflicts := testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeConflict))
+
+	require.NoError(t, labeler.setPrimaryLabel())
+
+	assert.Equal(t, []string{"7", "8"}, patchResourceVersions(t, k8sClient), "the retry is conditional on the pod read again")
+	assert.InDelta(t, conflicts+1, testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeConflict)), 0)
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, map[string]string{"role": "mongo", "app": "mongo", "primary": "true"}, labels["mongo-0"])
+}
+
+func TestSetPrimaryLabel_ConflictRedecidesChanges(t *testing.T) {
+	// Another labeler promoted mongo-0 in the meantime: once the pod is read
+	// again there is nothing left to patch.
+	k8sClient := newVersionedClientset(map[string]string{"mongo-0": "false"})
+	conflictOnce(t, k8sClient, "mongo-0", func(pod *corev1.Pod) { pod.Labels["primary"] = "true" })
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+
+	require.NoError(t, labeler.setPrimaryLabel())
+
+	assert.Equal(t, []string{"7"}, patchResourceVersions(t, k8sClient))
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, "true", labels["mongo-0"]["primary"])
+}
+
+func TestSetPrimaryLabel_GivesUpAfterRepeatedConflicts(t *testing.T) {
+	k8sClient := newVersionedClientset(map[string]string{"mongo-0": "false"})
+	k8sClient.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(corev1.Resource("pods"), "mongo-0", assert.AnError)
+	})
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+
+	err := labeler.setPrimaryLabel()
+	require.True(t, apierrors.IsConflict(err), "got %v", err)
+	assert.Len(t, patchResourceVersions(t, k8sClient), 5)
+}
+
+func TestSetPrimaryLabel_FieldOwnershipConflictIsNotRetried(t *testing.T) {
+	k8sClient := newVersionedClientset(map[string]string{"mongo-0": "false"})
+	k8sClient.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, &apierrors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusConflict,
+			Reason:  metav1.StatusReasonConflict,
+			Message: `Apply failed with 1 conflict: conflict with "argocd": .metadata.labels.primary`,
+			Details: &metav1.StatusDetails{Causes: []metav1.StatusCause{{
+				Type:    metav1.CauseTypeFieldManagerConflict,
+				Message: `conflict with "argocd"`,
+				Field:   ".metadata.labels.primary",
+			}}},
+		}}
+	})
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+	labeler.Config.ServerSideApply = true
+	conflicts := testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeConflict))
+	errs := testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeError))
+
+	err := labeler.setPrimaryLabel()
+	require.ErrorContains(t, err, `conflict with "argocd"`)
+	assert.Len(t, patchResourceVersions(t, k8sClient), 1, "an ownership conflict is not retried")
+	assert.InDelta(t, conflicts, testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeConflict)), 0)
+	assert.InDelta(t, errs+1, testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeError)), 0)
+}
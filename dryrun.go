@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	phuslog "github.com/phuslu/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// logDryRunPatch logs the patch DRY_RUN holds back from pod, with the before
+// and after value of every label and annotation it would change.
+func (l *Labeler) logDryRunPatch(pod *corev1.Pod, labels, annotations map[string]any, patch []byte) {
+	entry := withReplicaSet(phuslog.Info(), l.Config.Name).
+		Str("pod", pod.GetName()).
+		Strs("labels", describeChanges(pod.Labels, labels))
+	if len(annotations) > 0 {
+		entry = entry.Strs("annotations", describeChanges(pod.Annotations, annotations))
+	}
+	entry.Str("patch", string(patch)).Msg("dry run: pod not patched")
+}
+
+// describeChanges renders changes as `key: "before" -> "after"`, sorted by
+// key, with <none> for a value that is absent before or removed after.
+func describeChanges(current map[string]string, changes map[string]any) []string {
+	descriptions := make([]string, 0, len(changes))
+	for _, key := range slices.Sorted(maps.Keys(changes)) {
+		before := "<none>"
+		if value, ok := current[key]; ok {
+			before = fmt.Sprintf("%q", value)
+		}
+		after := "<none>"
+		if value, ok := changes[key].(string); ok {
+			after = fmt.Sprintf("%q", value)
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s: %s -> %s", key, before, after))
+	}
+	return descriptions
+}
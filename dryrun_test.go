@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSetPrimaryLabel_DryRun(t *testing.T) {
+	k8sClient := newClientsetWithPrimary("default", map[string]string{"mongo-0": "true", "mongo-1": "false", "mongo-2": "false"})
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+	labeler.Config.DryRun = true
+	labeler.selfRef = &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "mongo-0"}
+	events := &eventLog{t: t}
+	labeler.eventRecorder = events
+	dryRuns := testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeDryRun))
+	successes := testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeSuccess))
+
+	require.NoError(t, labeler.setPrimaryLabel())
+
+	for _, action := range k8sClient.Actions() {
+		assert.NotEqual(t, "patch", action.GetVerb(), "DRY_RUN must not patch pods")
+	}
+	assert.InDelta(t, dryRuns+2, testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeDryRun)), 0, "the demotion of mongo-0 and the promotion of mongo-1")
+	assert.InDelta(t, successes, testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeSuccess)), 0)
+	assert.Empty(t, events.events, "no transition happened")
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, "true", labels["mongo-0"]["primary"])
+	assert.Equal(t, "false", labels["mongo-1"]["primary"])
+}
+
+func TestDescribeChanges(t *testing.T) {
+	current := map[string]string{"primary": "true", "mongo-role": "primary", "app": "mongo"}
+	changes := map[string]any{"primary": nil, "mongo-role": "secondary", "mongo-lag": "ok"}
+
+	assert.Equal(t, []string{
+		`mongo-lag: <none> -> "ok"`,
+		`mongo-role: "primary" -> "secondary"`,
+		`primary: "true" -> <none>`,
+	}, describeChanges(current, changes))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source component of the Events the labeler records.
+const eventComponent = "mongo-labeler-sidecar"
+
+// Event reasons. PrimaryElected and PrimaryDemoted are attached to the pods
+// whose primary label flips; failures are attached to the sidecar's own pod.
+const (
+	reasonPrimaryElected  = "PrimaryElected"
+	reasonPrimaryDemoted  = "PrimaryDemoted"
+	reasonPrimaryNotFound = "PrimaryNotFound"
+	reasonStalePrimary    = "StalePrimary"
+	reasonNoPrimary       = "NoPrimary"
+	reasonReconcileFailed = "ReconcileFailed"
+)
+
+// errPrimaryNotFound is returned by setPrimaryLabel when the primary reported
+// by MongoDB is not among the selected pods.
+var errPrimaryNotFound = errors.New("primary not found")
+
+// startEventRecorder starts an event broadcaster that writes core/v1 Events
+// until ctx is cancelled. Repeated events are aggregated and rate
+// limited by client-go, so a persistent failure does not flood the API server.
+func (l *Labeler) startEventRecorder(ctx context.Context) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("get hostname for event source: %w", err)
+	}
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		// The sink creates each Event in the namespace of its object.
+		Interface: l.K8sClient.CoreV1().Events(""),
+	})
+	go func() {
+		<-ctx.Done()
+		broadcaster.Shutdown()
+	}()
+
+	l.eventRecorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: hostname})
+	// Inside a pod the hostname is the pod name. A central labeler set up
+	// with REPLICA_SETS_FILE does not run in the namespace of the replica
+	// sets, so POD_NAMESPACE (from the downward API) takes precedence.
+	l.selfRef = &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  envString("POD_NAMESPACE", l.Config.Namespace),
+		Name:       hostname,
+	}
+	return nil
+}
+
+// recordEvent records an Event on object; it is a no-op until
+// startEventRecorder has run.
+func (l *Labeler) recordEvent(object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	if l.eventRecorder == nil || object == nil {
+		return
+	}
+	l.eventRecorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// recordReconcileFailure records a Warning event for a failed reconcile on the
+// sidecar's own pod.
+func (l *Labeler) recordReconcileFailure(err error) {
+	if l.selfRef == nil {
+		return
+	}
+	reason := reasonReconcileFailed
+	switch {
+	case errors.Is(err, errPrimaryNotFound):
+		reason = reasonPrimaryNotFound
+	case errors.Is(err, errStalePrimary):
+		reason = reasonStalePrimary
+	case errors.Is(err, errNoPrimary):
+		reason = reasonNoPrimary
+	}
+	l.recordEvent(l.selfRef, corev1.EventTypeWarning, reason, "%v", err)
+}
+
+// recordPrimaryTransition records PrimaryElected or PrimaryDemoted on pod when
+// the label changes flip its primary label. Nothing is recorded with DRY_RUN,
+// as the label does not actually change.
+func (l *Labeler) recordPrimaryTransition(pod *corev1.Pod, changes map[string]any, primaryPodName string) {
+	primaryLabel := l.Config.PrimaryLabel
+	want, ok := changes[primaryLabel.Key]
+	if !ok || l.Config.DryRun {
+		return
+	}
+	switch {
+	case want == primaryLabel.Value:
+		l.recordEvent(pod, corev1.EventTypeNormal, reasonPrimaryElected, "Pod is the MongoDB primary, labelled %s", primaryLabel)
+	case pod.Labels[primaryLabel.Key] == primaryLabel.Value && primaryPodName == "":
+		l.recordEvent(pod, corev1.EventTypeNormal, reasonPrimaryDemoted, "Pod is no longer the MongoDB primary, the replica set has no primary")
+	case pod.Labels[primaryLabel.Key] == primaryLabel.Value:
+		l.recordEvent(pod, corev1.EventTypeNormal, reasonPrimaryDemoted, "Pod is no longer the MongoDB primary, new primary is %s", primaryPodName)
+	}
+}
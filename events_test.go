@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// eventLog is a record.EventRecorder that keeps "<object> <type> <reason>: <message>" lines.
+type eventLog struct {
+	t      *testing.T
+	events []string
+}
+
+func (e *eventLog) Event(object runtime.Object, eventType, reason, message string) {
+	var name string
+	if ref, ok := object.(*corev1.ObjectReference); ok {
+		name = ref.Name
+	} else {
+		meta, ok := object.(metav1.Object)
+		require.True(e.t, ok, "unexpected event object %T", object)
+		name = meta.GetName()
+	}
+	e.events = append(e.events, fmt.Sprintf("%s %s %s: %s", name, eventType, reason, message))
+}
+
+func (e *eventLog) Eventf(object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	e.Event(object, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (e *eventLog) AnnotatedEventf(object runtime.Object, _ map[string]string, eventType, reason, messageFmt string, args ...any) {
+	e.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+func TestSetPrimaryLabel_RecordsFailoverEvents(t *testing.T) {
+	for _, labelAll := range []bool{true, false} {
+		t.Run(fmt.Sprintf("labelAll=%t", labelAll), func(t *testing.T) {
+			k8sClient := newClientsetWithPrimary("default", map[string]string{
+				"mongo-0": "true",
+				"mongo-1": "false",
+				"mongo-2": "false",
+			})
+			labeler := newTestLabeler(k8sClient, labelAll, "mongo-1")
+			events := &eventLog{t: t}
+			labeler.eventRecorder = events
+
+			require.NoError(t, labeler.setPrimaryLabel())
+			assert.Equal(t, []string{
+				"mongo-0 Normal PrimaryDemoted: Pod is no longer the MongoDB primary, new primary is mongo-1",
+				"mongo-1 Normal PrimaryElected: Pod is the MongoDB primary, labelled primary=true",
+			}, events.events)
+
+			// A steady state records nothing further.
+			events.events = nil
+			k8sClient.ClearActions()
+			labeler.topologyResolver = func() (*topology, error) {
+				return &topology{Primary: "mongo-1"}, nil
+			}
+			require.NoError(t, labeler.setPrimaryLabel())
+			assert.Empty(t, events.events)
+		})
+	}
+}
+
+func TestReconcile_RecordsFailureEvents(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	labeler := newTestLabeler(k8sClient, true, "mongo-9")
+	events := &eventLog{t: t}
+	labeler.eventRecorder = events
+	labeler.selfRef = &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "mongo-0"}
+
+	require.ErrorIs(t, labeler.reconcile(), errPrimaryNotFound)
+
+	labeler.topologyResolver = func() (*topology, error) {
+		return nil, errors.New("mongo unavailable")
+	}
+	require.Error(t, labeler.reconcile())
+
+	assert.Equal(t, []string{
+		`mongo-0 Warning PrimaryNotFound: primary not found: no pod named "mongo-9" matches selector "role=mongo"`,
+		"mongo-0 Warning ReconcileFailed: resolve primary pod name: mongo unavailable",
+	}, events.events)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errStalePrimary is returned by setPrimaryLabel with ELECTION_FENCING when a
+// replica set reports a primary from an election older than one already seen.
+var errStalePrimary = errors.New("stale primary")
+
+// pv1ElectionIDPrefix starts every electionId of replication protocol
+// version 1, in which the remaining eight bytes hold the election term.
+const pv1ElectionIDPrefix = 0x7fffffff
+
+// checkElection fences top against the newest election seen for its replica
+// set, by this labeler or in the election-id annotation of any of its pods, so
+// that sidecars with ANNOTATE_PODS share what they have seen. It returns
+// errStalePrimary if top comes from an older election, and otherwise records
+// top's election as the newest.
+func (l *Labeler) checkElection(top *topology, pods []*corev1.Pod) error {
+	fence := l.lastElection[top.Shard]
+	for _, pod := range pods {
+		id, err := bson.ObjectIDFromHex(pod.Annotations[electionIDAnnotation])
+		if err == nil && bytes.Compare(id[:], fence[:]) > 0 {
+			fence = id
+		}
+	}
+	if isStaleElection(top, fence) {
+		return fmt.Errorf("%w: %q was reported by %s, older than election %s", errStalePrimary, top.Primary, describeElection(top), fence.Hex())
+	}
+
+	if bytes.Compare(top.ElectionID[:], fence[:]) > 0 {
+		fence = top.ElectionID
+	}
+	if !fence.IsZero() {
+		if l.lastElection == nil {
+			l.lastElection = map[string]bson.ObjectID{}
+		}
+		l.lastElection[top.Shard] = fence
+	}
+	return nil
+}
+
+// isStaleElection reports whether top comes from an election older than
+// fence. Only the primary reports electionId; for an answer from another
+// member its lastWrite term is compared with the term in fence instead. When
+// neither is known top is accepted.
+func isStaleElection(top *topology, fence bson.ObjectID) bool {
+	if fence.IsZero() {
+		return false
+	}
+	if !top.ElectionID.IsZero() {
+		return bytes.Compare(top.ElectionID[:], fence[:]) < 0
+	}
+	fenceTerm, ok := electionTerm(fence)
+	return ok && top.Term != 0 && top.Term < fenceTerm
+}
+
+// electionTerm returns the term encoded in a protocol version 1 electionId.
+func electionTerm(id bson.ObjectID) (int64, bool) {
+	if binary.BigEndian.Uint32(id[:4]) != pv1ElectionIDPrefix {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(id[4:])), true
+}
+
+// describeElection names the election top was reported in, for errors.
+func describeElection(top *topology) string {
+	if !top.ElectionID.IsZero() {
+		return "election " + top.ElectionID.Hex()
+	}
+	return "term " + strconv.FormatInt(top.Term, 10)
+}
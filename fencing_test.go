@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// pv1ElectionID returns the protocol version 1 electionId of term.
+func pv1ElectionID(term byte) bson.ObjectID {
+	return bson.ObjectID{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, term}
+}
+
+func TestIsStaleElection(t *testing.T) {
+	tests := []struct {
+		name  string
+		top   *topology
+		fence bson.ObjectID
+		want  bool
+	}{
+		{name: "no fence", top: &topology{ElectionID: pv1ElectionID(1)}},
+		{name: "same election", top: &topology{ElectionID: pv1ElectionID(2)}, fence: pv1ElectionID(2)},
+		{name: "newer election", top: &topology{ElectionID: pv1ElectionID(3)}, fence: pv1ElectionID(2)},
+		{name: "older election", top: &topology{ElectionID: pv1ElectionID(1)}, fence: pv1ElectionID(2), want: true},
+		{name: "secondary with an older term", top: &topology{Term: 1}, fence: pv1ElectionID(2), want: true},
+		{name: "secondary with the current term", top: &topology{Term: 2}, fence: pv1ElectionID(2)},
+		{name: "nothing known", top: &topology{}, fence: pv1ElectionID(2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isStaleElection(tt.top, tt.fence))
+		})
+	}
+}
+
+func TestSetPrimaryLabel_ElectionFencing(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.Config.ElectionFencing = true
+	report := func(primary string, term byte) {
+		labeler.topologyResolver = func() (*topology, error) {
+			return &topology{Primary: primary, ElectionID: pv1ElectionID(term)}, nil
+		}
+	}
+
+	report("mongo-1", 2)
+	require.NoError(t, labeler.setPrimaryLabel())
+
+	// An isolated old primary, or a sidecar behind, reports the old election.
+	report("mongo-0", 1)
+	err := labeler.setPrimaryLabel()
+	require.ErrorIs(t, err, errStalePrimary)
+	assert.EqualError(t, err, `stale primary: "mongo-0" was reported by election 7fffffff0000000000000001, older than election 7fffffff0000000000000002`)
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, "true", labels["mongo-1"]["primary"], "the newer primary keeps its label")
+	assert.Equal(t, "false", labels["mongo-0"]["primary"])
+
+	report("mongo-0", 3)
+	require.NoError(t, labeler.setPrimaryLabel())
+	labels, _ = podMetadata(t, k8sClient)
+	assert.Equal(t, "true", labels["mongo-0"]["primary"])
+	assert.Equal(t, pv1ElectionID(3), labeler.lastElection[""])
+}
+
+func TestSetPrimaryLabel_ElectionFencingFromAnnotations(t *testing.T) {
+	k8sClient := fake.NewClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "mongo-0", Namespace: "default", Labels: map[string]string{"role": "mongo"}}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "mongo-1",
+			Namespace:   "default",
+			Labels:      map[string]string{"role": "mongo", "primary": "true"},
+			Annotations: map[string]string{electionIDAnnotation: pv1ElectionID(5).Hex()},
+		}},
+	)
+
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.Config.ElectionFencing = true
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-0", Term: 4}, nil
+	}
+	labeler.selfRef = &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "mongo-0"}
+	events := &eventLog{t: t}
+	labeler.eventRecorder = events
+
+	require.ErrorIs(t, labeler.reconcile(), errStalePrimary, "another sidecar has seen election 5")
+	require.Len(t, events.events, 1)
+	assert.Contains(t, events.events[0], "mongo-0 Warning StalePrimary: stale primary")
+}
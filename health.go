@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// minLivenessStallTimeout is the shortest time the reconcile loop may go
+// without starting a reconcile before /healthz fails. livenessStallMargin is
+// added on top of the longest wait between two reconciles for the reconcile
+// itself to run.
+const (
+	minLivenessStallTimeout = 5 * time.Minute
+	livenessStallMargin     = time.Minute
+)
+
+// Defaults for READINESS_FAILURE_THRESHOLD and READINESS_MAX_STALENESS.
+const (
+	defaultReadinessFailureThreshold = 3
+	defaultReadinessMaxStaleness     = 2 * time.Minute
+)
+
+// livenessStallTimeout is how long the reconcile loop may go without starting
+// a reconcile before /healthz fails: well above both RECONCILE_INTERVAL and the
+// longest jittered retry delay, so it only trips when the loop itself is
+// wedged.
+func (l *Labeler) livenessStallTimeout() time.Duration {
+	longest := max(l.Config.ReconcileInterval, maxReconcileBackoff)
+	return max(minLivenessStallTimeout, time.Duration(float64(longest)*(1+reconcileBackoffJitter))+livenessStallMargin)
+}
+
+// checkLive reports an error when the reconcile loop has not started a
+// reconcile within livenessStallTimeout.
+func (l *Labeler) checkLive(now time.Time) error {
+	last := l.startedAt
+	if nanos := l.lastAttempt.Load(); nanos != 0 {
+		last = time.Unix(0, nanos)
+	}
+	if stalled := now.Sub(last); stalled > l.livenessStallTimeout() {
+		return fmt.Errorf("no reconcile started for %s", stalled.Round(time.Second))
+	}
+	return nil
+}
+
+// checkReady reports an error when labels are not converging: after
+// READINESS_FAILURE_THRESHOLD consecutive failed reconciles, or when the last
+// success is older than READINESS_MAX_STALENESS. A standby sidecar under leader
+// election does not reconcile and is always ready, and so is one waiting for
+// the replica set's first primary.
+func (l *Labeler) checkReady(now time.Time) error {
+	if !l.isLeader() || l.awaitingPrimary.Load() {
+		return nil
+	}
+	threshold := l.Config.ReadinessFailureThreshold
+	if failures := l.consecutiveFailures.Load(); threshold > 0 && failures >= int64(threshold) {
+		return fmt.Errorf("%d consecutive reconciles failed", failures)
+	}
+	maxStaleness := l.Config.ReadinessMaxStaleness
+	if stale := now.Sub(l.lastSuccessTime()); maxStaleness > 0 && stale > maxStaleness {
+		return fmt.Errorf("no successful reconcile for %s", stale.Round(time.Second))
+	}
+	return nil
+}
+
+// probeHandler serves check as a Kubernetes probe endpoint: 200 "ok", or 503
+// with the reason.
+func probeHandler(check func(time.Time) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(time.Now()); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintln(w, err)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckLive(t *testing.T) {
+	start := time.Now()
+	labeler := &Labeler{Config: &Config{}, startedAt: start}
+
+	// Before the first reconcile the stall timeout runs from startup.
+	require.NoError(t, labeler.checkLive(start.Add(minLivenessStallTimeout)))
+	require.ErrorContains(t, labeler.checkLive(start.Add(minLivenessStallTimeout+time.Second)), "no reconcile started")
+
+	labeler.lastAttempt.Store(start.Add(time.Hour).UnixNano())
+	require.NoError(t, labeler.checkLive(start.Add(time.Hour+time.Minute)))
+}
+
+func TestCheckLive_LongReconcileInterval(t *testing.T) {
+	start := time.Now()
+	labeler := &Labeler{Config: &Config{ReconcileInterval: 10 * time.Minute}, startedAt: start}
+	labeler.lastAttempt.Store(start.UnixNano())
+
+	// Waiting a full interval, even with retry jitter on top, is not a stall.
+	require.NoError(t, labeler.checkLive(start.Add(15*time.Minute)))
+	require.ErrorContains(t, labeler.checkLive(start.Add(15*time.Minute+livenessStallMargin+time.Second)), "no reconcile started")
+}
+
+func TestCheckReady(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name                  string
+		leaseName             string
+		failures              int64
+		lastSuccess           time.Time
+		expectedErrorContains string
+	}{
+		{
+			name:        "recent success",
+			lastSuccess: now.Add(-time.Minute),
+		},
+		{
+			name:        "failures below threshold",
+			failures:    2,
+			lastSuccess: now.Add(-time.Minute),
+		},
+		{
+			name:                  "failures reach threshold",
+			failures:              3,
+			lastSuccess:           now.Add(-time.Minute),
+			expectedErrorContains: "3 consecutive reconciles failed",
+		},
+		{
+			name:                  "last success too old",
+			lastSuccess:           now.Add(-3 * time.Minute),
+			expectedErrorContains: "no successful reconcile for 3m0s",
+		},
+		{
+			name:        "standby is always ready",
+			leaseName:   "mongo-labeler",
+			failures:    10,
+			lastSuccess: now.Add(-time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labeler := &Labeler{
+				Config: &Config{
+					LeaderElectionLeaseName:   tt.leaseName,
+					ReadinessFailureThreshold: defaultReadinessFailureThreshold,
+					ReadinessMaxStaleness:     defaultReadinessMaxStaleness,
+				},
+				startedAt: now.Add(-time.Hour),
+			}
+			labeler.consecutiveFailures.Store(tt.failures)
+			labeler.lastSuccess.Store(tt.lastSuccess.UnixNano())
+
+			err := labeler.checkReady(now)
+			if tt.expectedErrorContains != "" {
+				require.ErrorContains(t, err, tt.expectedErrorContains)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckReady_ZeroDisablesChecks(t *testing.T) {
+	labeler := &Labeler{Config: &Config{}, startedAt: time.Now().Add(-time.Hour)}
+	labeler.consecutiveFailures.Store(100)
+	require.NoError(t, labeler.checkReady(time.Now()))
+}
+
+func TestReconcile_TracksConsecutiveFailures(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+	labeler.topologyResolver = func() (*topology, error) {
+		return nil, errors.New("mongo unavailable")
+	}
+
+	require.Error(t, labeler.reconcile())
+	require.Error(t, labeler.reconcile())
+	assert.EqualValues(t, 2, labeler.consecutiveFailures.Load())
+	assert.WithinDuration(t, time.Now(), time.Unix(0, labeler.lastAttempt.Load()), time.Second)
+
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-1"}, nil
+	}
+	require.NoError(t, labeler.reconcile())
+	assert.Zero(t, labeler.consecutiveFailures.Load())
+}
+
+func TestReconcile_NoPrimaryBeforeFirstSuccess(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.Config.ReadinessFailureThreshold = 1
+	labeler.Config.ReadinessMaxStaleness = time.Minute
+	labeler.startedAt = time.Now().Add(-time.Hour)
+	labeler.topologyResolver = func() (*topology, error) {
+		return nil, errNoPrimary
+	}
+
+	// Before rs.initiate no member reports a primary.
+	require.ErrorIs(t, labeler.reconcile(), errNoPrimary)
+	require.ErrorIs(t, labeler.reconcile(), errNoPrimary)
+	assert.Zero(t, labeler.consecutiveFailures.Load())
+	require.NoError(t, labeler.checkReady(time.Now()), "a replica set that never had a primary does not make the pod unready")
+
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-1"}, nil
+	}
+	require.NoError(t, labeler.reconcile())
+
+	labeler.topologyResolver = func() (*topology, error) {
+		return nil, errNoPrimary
+	}
+	require.ErrorIs(t, labeler.reconcile(), errNoPrimary)
+	assert.EqualValues(t, 1, labeler.consecutiveFailures.Load(), "losing the primary later counts")
+	require.ErrorContains(t, labeler.checkReady(time.Now()), "1 consecutive reconciles failed")
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	labeler := &Labeler{
+		Config:    &Config{ReadinessFailureThreshold: 1},
+		startedAt: time.Now(),
+	}
+	server := httptest.NewServer(newHTTPHandler(labeler))
+	t.Cleanup(server.Close)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	labeler.consecutiveFailures.Store(1)
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "1 consecutive reconciles failed")
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code, "liveness ignores reconcile failures")
+}
+
+func TestProbeEndpoints_ReportEveryReplicaSet(t *testing.T) {
+	healthy := &Labeler{Config: &Config{Name: "users", ReadinessFailureThreshold: 1}, startedAt: time.Now()}
+	failing := &Labeler{Config: &Config{Name: "orders", ReadinessFailureThreshold: 1}, startedAt: time.Now()}
+	failing.consecutiveFailures.Store(1)
+
+	rec := httptest.NewRecorder()
+	newHTTPHandler(healthy, failing).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "replica set \"orders\": 1 consecutive reconciles failed\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	newHTTPHandler(healthy, failing).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// HOST_MAPPING strategies, which decide how the member addresses reported by
+// MongoDB ("host:port") are matched to pods.
+const (
+	// hostMappingDNSPrefix takes the first DNS label of the host, which is the
+	// pod name for StatefulSet members addressed through a headless Service.
+	hostMappingDNSPrefix = "dns-prefix"
+	// hostMappingPodIP matches the host against status.podIPs.
+	hostMappingPodIP = "pod-ip"
+	// hostMappingHostname matches the host against spec.hostname, followed by
+	// spec.subdomain when the pod has one.
+	hostMappingHostname = "hostname"
+	// hostMappingRegex extracts the pod name with HOST_MAPPING_REGEX.
+	hostMappingRegex = "regex"
+	// hostMappingTemplate renders the pod name with HOST_MAPPING_TEMPLATE.
+	hostMappingTemplate = "template"
+)
+
+// defaultHostMapping is the historical DNS prefix mapping.
+var defaultHostMapping = HostMapping{Strategy: hostMappingDNSPrefix}
+
+// HostMapping is the HOST_MAPPING strategy plus the regex or template it
+// needs.
+type HostMapping struct {
+	Strategy string
+	Regex    *regexp.Regexp
+	Template *template.Template
+}
+
+// hostMapper maps a member address ("host:port") to the name of the pod that
+// serves it, or "" when it matches no pod.
+type hostMapper func(hostPort string) string
+
+// hostTemplateData is the data HOST_MAPPING_TEMPLATE is executed with. For
+// "mongo-0.db.example.com:27017" Host is "mongo-0.db.example.com", Port is
+// "27017" and Labels is ["mongo-0", "db", "example", "com"].
+type hostTemplateData struct {
+	Host   string
+	Port   string
+	Labels []string
+}
+
+// hostTemplateFuncs are the functions available to HOST_MAPPING_TEMPLATE, in
+// addition to the text/template builtins. They take the string last so they
+// can end a pipeline: {{index .Labels 0 | trimSuffix "-external"}}.
+var hostTemplateFuncs = template.FuncMap{
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, replacement, s string) string { return strings.ReplaceAll(s, old, replacement) },
+}
+
+// getHostMappingFromEnvironment reads HOST_MAPPING, HOST_MAPPING_REGEX and
+// HOST_MAPPING_TEMPLATE. The regex and the template are compiled here so that
+// a typo fails startup.
+func getHostMappingFromEnvironment() (HostMapping, error) {
+	mapping := HostMapping{Strategy: envString("HOST_MAPPING", defaultHostMapping.Strategy)}
+	pattern, hasRegex := lookupNonEmptyEnv("HOST_MAPPING_REGEX")
+	text, hasTemplate := lookupNonEmptyEnv("HOST_MAPPING_TEMPLATE")
+	if hasRegex != (mapping.Strategy == hostMappingRegex) {
+		return HostMapping{}, fmt.Errorf("HOST_MAPPING_REGEX must be set if and only if HOST_MAPPING=%s", hostMappingRegex)
+	}
+	if hasTemplate != (mapping.Strategy == hostMappingTemplate) {
+		return HostMapping{}, fmt.Errorf("HOST_MAPPING_TEMPLATE must be set if and only if HOST_MAPPING=%s", hostMappingTemplate)
+	}
+
+	switch mapping.Strategy {
+	case hostMappingDNSPrefix, hostMappingPodIP, hostMappingHostname:
+	case hostMappingRegex:
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return HostMapping{}, fmt.Errorf("invalid HOST_MAPPING_REGEX value %q: %w", pattern, err)
+		}
+		if regex.NumSubexp() == 0 {
+			return HostMapping{}, fmt.Errorf("invalid HOST_MAPPING_REGEX value %q: needs a capture group for the pod name", pattern)
+		}
+		mapping.Regex = regex
+	case hostMappingTemplate:
+		tmpl, err := template.New("HOST_MAPPING_TEMPLATE").Funcs(hostTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return HostMapping{}, fmt.Errorf("invalid HOST_MAPPING_TEMPLATE value %q: %w", text, err)
+		}
+		mapping.Template = tmpl
+	default:
+		return HostMapping{}, fmt.Errorf(
+			"invalid HOST_MAPPING value %q: must be one of %s, %s, %s, %s or %s",
+			mapping.Strategy, hostMappingDNSPrefix, hostMappingPodIP, hostMappingHostname, hostMappingRegex, hostMappingTemplate,
+		)
+	}
+	return mapping, nil
+}
+
+// lookupNonEmptyEnv returns the value of key and whether it is set and not
+// empty.
+func lookupNonEmptyEnv(key string) (string, bool) {
+	v, ok := os.LookupEnv(key)
+	return v, ok && v != ""
+}
+
+// String returns the strategy name, with its regex or template.
+func (m HostMapping) String() string {
+	switch {
+	case m.Regex != nil:
+		return m.Strategy + " " + m.Regex.String()
+	case m.Template != nil:
+		return m.Strategy + " " + m.Template.Root.String()
+	}
+	return m.Strategy
+}
+
+// needsPods reports whether the strategy matches hosts against pod fields.
+func (m HostMapping) needsPods() bool {
+	return m.Strategy == hostMappingPodIP || m.Strategy == hostMappingHostname
+}
+
+// hostMapper returns the HOST_MAPPING strategy as a hostMapper. The pod-ip
+// and hostname strategies read the selected pods, from the informer cache once
+// it has synced.
+func (l *Labeler) hostMapper(ctx context.Context) (hostMapper, error) {
+	mapping := l.Config.HostMapping
+	if !mapping.needsPods() {
+		return mapping.mapper(nil), nil
+	}
+	listCtx, cancel := context.WithTimeout(ctx, l.Config.K8sRequestTimeout)
+	defer cancel()
+	pods, err := l.listPods(listCtx)
+	if err != nil {
+		kubernetesErrorsTotal.WithLabelValues(l.Config.Name, "list").Inc()
+		return nil, fmt.Errorf("list pods to map mongo hosts by %s: %w", mapping.Strategy, err)
+	}
+	return mapping.mapper(pods), nil
+}
+
+// mapper builds the hostMapper of the strategy; pods are only used by pod-ip
+// and hostname.
+func (m HostMapping) mapper(pods []*corev1.Pod) hostMapper {
+	switch m.Strategy {
+	case hostMappingPodIP:
+		byIP := map[string]string{}
+		for _, pod := range pods {
+			if pod.Status.PodIP != "" {
+				byIP[pod.Status.PodIP] = pod.Name
+			}
+			for _, podIP := range pod.Status.PodIPs {
+				byIP[podIP.IP] = pod.Name
+			}
+		}
+		return func(hostPort string) string {
+			host, _, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				return ""
+			}
+			return byIP[host]
+		}
+	case hostMappingHostname:
+		byHostname := map[string]string{}
+		for _, pod := range pods {
+			// The kubelet uses the pod name when spec.hostname is unset.
+			hostname := pod.Spec.Hostname
+			if hostname == "" {
+				hostname = pod.Name
+			}
+			if pod.Spec.Subdomain != "" {
+				hostname += "." + pod.Spec.Subdomain
+			}
+			byHostname[hostname] = pod.Name
+		}
+		return func(hostPort string) string {
+			host, _, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				return ""
+			}
+			labels := strings.Split(host, ".")
+			if len(labels) >= 2 {
+				if podName, ok := byHostname[labels[0]+"."+labels[1]]; ok {
+					return podName
+				}
+			}
+			return byHostname[labels[0]]
+		}
+	case hostMappingRegex:
+		group := 1
+		if i := m.Regex.SubexpIndex("pod"); i > 0 {
+			group = i
+		}
+		return func(hostPort string) string {
+			host, _, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				return ""
+			}
+			match := m.Regex.FindStringSubmatch(host)
+			if match == nil {
+				return ""
+			}
+			return match[group]
+		}
+	case hostMappingTemplate:
+		return func(hostPort string) string {
+			host, port, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				return ""
+			}
+			var podName strings.Builder
+			data := hostTemplateData{Host: host, Port: port, Labels: strings.Split(host, ".")}
+			if err := m.Template.Execute(&podName, data); err != nil {
+				return ""
+			}
+			return strings.TrimSpace(podName.String())
+		}
+	}
+	return podNameFromHost
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetHostMappingFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantStrategy string
+		wantErr      string
+	}{
+		{name: "default", env: map[string]string{}, wantStrategy: hostMappingDNSPrefix},
+		{name: "pod ip", env: map[string]string{"HOST_MAPPING": "pod-ip"}, wantStrategy: hostMappingPodIP},
+		{name: "hostname", env: map[string]string{"HOST_MAPPING": "hostname"}, wantStrategy: hostMappingHostname},
+		{
+			name:         "regex",
+			env:          map[string]string{"HOST_MAPPING": "regex", "HOST_MAPPING_REGEX": `^(?P<pod>[a-z0-9-]+)-ext\.`},
+			wantStrategy: hostMappingRegex,
+		},
+		{
+			name:         "template",
+			env:          map[string]string{"HOST_MAPPING": "template", "HOST_MAPPING_TEMPLATE": `{{index .Labels 0}}`},
+			wantStrategy: hostMappingTemplate,
+		},
+		{name: "unknown strategy", env: map[string]string{"HOST_MAPPING": "dns"}, wantErr: `invalid HOST_MAPPING value "dns"`},
+		{name: "regex missing", env: map[string]string{"HOST_MAPPING": "regex"}, wantErr: "HOST_MAPPING_REGEX must be set"},
+		{
+			name:    "regex without regex strategy",
+			env:     map[string]string{"HOST_MAPPING_REGEX": "^(.*)$"},
+			wantErr: "HOST_MAPPING_REGEX must be set if and only if HOST_MAPPING=regex",
+		},
+		{
+			name:    "invalid regex",
+			env:     map[string]string{"HOST_MAPPING": "regex", "HOST_MAPPING_REGEX": "^(mongo"},
+			wantErr: "invalid HOST_MAPPING_REGEX value",
+		},
+		{
+			name:    "regex without capture group",
+			env:     map[string]string{"HOST_MAPPING": "regex", "HOST_MAPPING_REGEX": "^mongo"},
+			wantErr: "needs a capture group",
+		},
+		{
+			name:    "invalid template",
+			env:     map[string]string{"HOST_MAPPING": "template", "HOST_MAPPING_TEMPLATE": "{{.Host"},
+			wantErr: "invalid HOST_MAPPING_TEMPLATE value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfigEnv(t, tt.env)
+			mapping, err := getHostMappingFromEnvironment()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStrategy, mapping.Strategy)
+		})
+	}
+}
+
+func TestHostMappingMapper(t *testing.T) {
+	pods := []*corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "mongo-0"},
+			Spec:       corev1.PodSpec{Hostname: "db-a", Subdomain: "mongo"},
+			Status:     corev1.PodStatus{PodIP: "10.0.0.5", PodIPs: []corev1.PodIP{{IP: "10.0.0.5"}, {IP: "fd00::5"}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "mongo-1"},
+			Status:     corev1.PodStatus{PodIP: "10.0.0.6"},
+		},
+	}
+	mustMapping := func(env map[string]string) HostMapping {
+		setConfigEnv(t, env)
+		mapping, err := getHostMappingFromEnvironment()
+		require.NoError(t, err)
+		return mapping
+	}
+
+	tests := []struct {
+		name    string
+		mapping HostMapping
+		want    map[string]string
+	}{
+		{
+			name:    "dns prefix",
+			mapping: defaultHostMapping,
+			want: map[string]string{
+				"mongo-0.mongo.default.svc.cluster.local:27017": "mongo-0",
+				"10.0.0.5:27017": "10",
+				"mongo-0":        "",
+			},
+		},
+		{
+			name:    "pod ip",
+			mapping: HostMapping{Strategy: hostMappingPodIP},
+			want: map[string]string{
+				"10.0.0.5:27017":  "mongo-0",
+				"[fd00::5]:27017": "mongo-0",
+				"10.0.0.6:27017":  "mongo-1",
+				"10.0.0.7:27017":  "",
+			},
+		},
+		{
+			name:    "hostname and subdomain",
+			mapping: HostMapping{Strategy: hostMappingHostname},
+			want: map[string]string{
+				"db-a.mongo.default.svc.cluster.local:27017": "mongo-0",
+				"db-a.other.default.svc.cluster.local:27017": "",
+				"mongo-1:27017":                      "mongo-1",
+				"mongo-1.anything.example.com:27017": "mongo-1",
+				"mongo-0.mongo:27017":                "",
+			},
+		},
+		{
+			name:    "regex with a named group",
+			mapping: mustMapping(map[string]string{"HOST_MAPPING": "regex", "HOST_MAPPING_REGEX": `^(db)-(?P<pod>mongo-\d+)\.`}),
+			want: map[string]string{
+				"db-mongo-2.example.com:27017": "mongo-2",
+				"mongo-2.example.com:27017":    "",
+			},
+		},
+		{
+			name:    "regex with the first group",
+			mapping: mustMapping(map[string]string{"HOST_MAPPING": "regex", "HOST_MAPPING_REGEX": `^(mongo-\d+)-ext\.`}),
+			want: map[string]string{
+				"mongo-3-ext.example.com:27017": "mongo-3",
+			},
+		},
+		{
+			name:    "template",
+			mapping: mustMapping(map[string]string{"HOST_MAPPING": "template", "HOST_MAPPING_TEMPLATE": `{{index .Labels 0 | trimSuffix "-ext"}}`}),
+			want: map[string]string{
+				"mongo-4-ext.example.com:27017": "mongo-4",
+				"not-a-host-port":               "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := tt.mapping.mapper(pods)
+			for host, want := range tt.want {
+				assert.Equal(t, want, hosts(host), host)
+			}
+		})
+	}
+}
+
+func TestSetPrimaryLabel_MapsHostsByPodIP(t *testing.T) {
+	pod := func(name, ip string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"role": "mongo"}},
+			Status:     corev1.PodStatus{PodIP: ip},
+		}
+	}
+	k8sClient := fake.NewClientset(pod("mongo-0", "10.0.0.5"), pod("mongo-1", "10.0.0.6"))
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.topologyResolver = nil
+	labeler.Config.LabelRoles = true
+	labeler.Config.HostMapping = HostMapping{Strategy: hostMappingPodIP}
+	labeler.helloFetcher = func(context.Context) (bson.M, error) {
+		return bson.M{"primary": "10.0.0.6:27017", "hosts": bson.A{"10.0.0.5:27017", "10.0.0.6:27017"}}, nil
+	}
+	labeler.configFetcher = func(context.Context) (bson.M, error) {
+		return bson.M{"config": bson.D{{Key: "members", Value: bson.A{
+			bson.D{{Key: "host", Value: "10.0.0.5:27017"}},
+			bson.D{{Key: "host", Value: "10.0.0.6:27017"}},
+		}}}}, nil
+	}
+
+	require.NoError(t, labeler.setPrimaryLabel())
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, map[string]map[string]string{
+		"mongo-0": {"role": "mongo", "primary": "false", roleLabel: roleSecondary},
+		"mongo-1": {"role": "mongo", "primary": "true", roleLabel: rolePrimary},
+	}, labels)
+}
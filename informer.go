@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	phuslog "github.com/phuslu/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerSyncTimeout bounds how long startPodInformer waits for the initial
+// pod list, for example when RBAC does not allow watching the namespace.
+const informerSyncTimeout = time.Minute
+
+// startPodInformer starts a shared informer over the pods matching
+// LABEL_SELECTOR in NAMESPACE and blocks until its cache has synced, for at
+// most informerSyncTimeout. From then
+// on setPrimaryLabel reads pods from the lister instead of listing them from
+// the apiserver on every reconcile, and any pod that appears or has one of the
+// managed labels changed by someone else queues a reconcile on podsChanged.
+//
+// The informer has no resync period of its own: the reconcile ticker already
+// provides one.
+func (l *Labeler) startPodInformer(ctx context.Context) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		l.K8sClient,
+		0,
+		informers.WithNamespace(l.Config.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = l.Config.LabelSelector
+		}),
+	)
+	podInformer := factory.Core().V1().Pods()
+
+	l.podsChanged = make(chan struct{}, 1)
+	_, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		// A new or recreated pod starts without our labels.
+		AddFunc: func(any) { notify(l.podsChanged) },
+		// Our own patches also land here; the reconcile they trigger finds
+		// nothing to change and issues no further patches.
+		UpdateFunc: func(oldObj, newObj any) {
+			oldPod, ok := oldObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			newPod, ok := newObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			if l.managedLabelsChanged(oldPod, newPod) {
+				withReplicaSet(phuslog.Debug(), l.Config.Name).Str("pod", newPod.Name).Msg("managed labels changed outside a reconcile")
+				notify(l.podsChanged)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("register pod informer handler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, informerSyncTimeout)
+	defer cancel()
+	for informerType, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return fmt.Errorf("sync %v informer cache in namespace %q", informerType, l.Config.Namespace)
+		}
+	}
+	l.podLister = podInformer.Lister()
+	return nil
+}
+
+// listPods returns the pods matching LABEL_SELECTOR, from the informer cache
+// when one has been started and from the apiserver otherwise.
+func (l *Labeler) listPods(ctx context.Context) ([]*corev1.Pod, error) {
+	if l.podLister != nil {
+		// The informer is already filtered by LABEL_SELECTOR.
+		return l.podLister.Pods(l.Config.Namespace).List(labels.Everything())
+	}
+
+	list, err := l.K8sClient.CoreV1().Pods(l.Config.Namespace).List(ctx, metav1.ListOptions{LabelSelector: l.Config.LabelSelector})
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]*corev1.Pod, 0, len(list.Items))
+	for i := range list.Items {
+		pods = append(pods, &list.Items[i])
+	}
+	return pods, nil
+}
+
+// managedLabelsChanged reports whether any label written by the labeler differs
+// between two versions of a pod.
+func (l *Labeler) managedLabelsChanged(oldPod, newPod *corev1.Pod) bool {
+	for _, key := range l.managedLabelKeys() {
+		oldValue, oldOK := oldPod.Labels[key]
+		newValue, newOK := newPod.Labels[key]
+		if oldOK != newOK || oldValue != newValue {
+			return true
+		}
+	}
+	return false
+}
+
+// managedLabelKeys lists the label keys the labeler writes.
+func (l *Labeler) managedLabelKeys() []string {
+	keys := []string{l.Config.PrimaryLabel.Key}
+	if l.Config.LabelRoles || l.Config.Sharded {
+		keys = append(keys, roleLabel)
+	}
+	if l.Config.Sharded {
+		keys = append(keys, shardLabel)
+	}
+	if l.Config.ReplicationLagThreshold > 0 {
+		keys = append(keys, lagLabel)
+	}
+	return keys
+}
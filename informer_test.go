@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// countPodLists returns how many pod list requests the fake client has seen.
+func countPodLists(k8sClient *fake.Clientset) int {
+	lists := 0
+	for _, action := range k8sClient.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "pods" {
+			lists++
+		}
+	}
+	return lists
+}
+
+func TestSetPrimaryLabel_ReadsFromInformerCache(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1", "mongo-2")
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, labeler.startPodInformer(ctx))
+
+	// The informer's initial list is the only one; reconciles read the cache.
+	listsAfterSync := countPodLists(k8sClient)
+	require.NoError(t, labeler.setPrimaryLabel())
+	assert.Equal(t, listsAfterSync, countPodLists(k8sClient))
+	assert.Equal(t, map[string]any{
+		"mongo-0": "false",
+		"mongo-1": "true",
+		"mongo-2": "false",
+	}, collectPrimaryPatchValues(t, k8sClient))
+}
+
+func TestStartPodInformer_QueuesReconcileOnManualLabelChange(t *testing.T) {
+	k8sClient := newClientsetWithPrimary("default", map[string]string{
+		"mongo-0": "true",
+		"mongo-1": "false",
+	})
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, labeler.startPodInformer(ctx))
+
+	// Drain the signals queued by the initial adds.
+	for drained := false; !drained; {
+		select {
+		case <-labeler.podsChanged:
+		case <-time.After(100 * time.Millisecond):
+			drained = true
+		}
+	}
+
+	// An unrelated label change does not queue a reconcile.
+	pod, err := k8sClient.CoreV1().Pods("default").Get(ctx, "mongo-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	pod.Labels["team"] = "data"
+	_, err = k8sClient.CoreV1().Pods("default").Update(ctx, pod, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Never(t, func() bool { return len(labeler.podsChanged) > 0 }, 200*time.Millisecond, 10*time.Millisecond)
+
+	// Someone stripping the primary label by hand does.
+	pod, err = k8sClient.CoreV1().Pods("default").Get(ctx, "mongo-0", metav1.GetOptions{})
+	require.NoError(t, err)
+	delete(pod.Labels, "primary")
+	_, err = k8sClient.CoreV1().Pods("default").Update(ctx, pod, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(labeler.podsChanged) > 0 }, time.Second, 10*time.Millisecond)
+}
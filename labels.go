@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// primaryLabelKeyAnnotation records on each pod the primary label key the
+// labeler last wrote, when it is not the default. After PRIMARY_LABEL_KEY
+// changes, the key it names is removed from the pod.
+const primaryLabelKeyAnnotation = "mongo-labeler/primary-label-key"
+
+// defaultPrimaryLabel is the historical primary=true|false label.
+var defaultPrimaryLabel = PrimaryLabel{
+	Key:             "primary",
+	Value:           "true",
+	NonPrimaryValue: "false",
+}
+
+// PrimaryLabel is the label written to the primary pod, and with LABEL_ALL to
+// the other pods.
+type PrimaryLabel struct {
+	Key             string
+	Value           string
+	NonPrimaryValue string
+}
+
+// getPrimaryLabelFromEnvironment reads PRIMARY_LABEL_KEY, PRIMARY_LABEL_VALUE
+// and NON_PRIMARY_LABEL_VALUE and validates them against Kubernetes label
+// syntax.
+func getPrimaryLabelFromEnvironment() (PrimaryLabel, error) {
+	label := PrimaryLabel{
+		Key:             envString("PRIMARY_LABEL_KEY", defaultPrimaryLabel.Key),
+		Value:           envString("PRIMARY_LABEL_VALUE", defaultPrimaryLabel.Value),
+		NonPrimaryValue: envString("NON_PRIMARY_LABEL_VALUE", defaultPrimaryLabel.NonPrimaryValue),
+	}
+	if err := label.validate(); err != nil {
+		return PrimaryLabel{}, err
+	}
+	return label, nil
+}
+
+func (p PrimaryLabel) validate() error {
+	if errs := validation.IsQualifiedName(p.Key); len(errs) > 0 {
+		return fmt.Errorf("invalid PRIMARY_LABEL_KEY value %q: %s", p.Key, strings.Join(errs, "; "))
+	}
+	if slices.Contains([]string{roleLabel, lagLabel, shardLabel, primaryLabelKeyAnnotation}, p.Key) {
+		return fmt.Errorf("invalid PRIMARY_LABEL_KEY value %q: reserved by the labeler", p.Key)
+	}
+	if p.Value == "" {
+		return fmt.Errorf("invalid PRIMARY_LABEL_VALUE value: must not be empty")
+	}
+	if errs := validation.IsValidLabelValue(p.Value); len(errs) > 0 {
+		return fmt.Errorf("invalid PRIMARY_LABEL_VALUE value %q: %s", p.Value, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsValidLabelValue(p.NonPrimaryValue); len(errs) > 0 {
+		return fmt.Errorf("invalid NON_PRIMARY_LABEL_VALUE value %q: %s", p.NonPrimaryValue, strings.Join(errs, "; "))
+	}
+	if p.NonPrimaryValue == p.Value {
+		return fmt.Errorf("invalid NON_PRIMARY_LABEL_VALUE value %q: must differ from PRIMARY_LABEL_VALUE", p.NonPrimaryValue)
+	}
+	return nil
+}
+
+// validateSelector rejects a label selector that uses the primary label key:
+// the labeler would rewrite or remove the label its pods are selected by, and
+// they would drop out of its own informer and of their Services. name is the
+// setting the selector comes from, for the error message.
+func (p PrimaryLabel) validateSelector(name, selector string) error {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return fmt.Errorf("invalid %s value %q: %w", name, selector, err)
+	}
+	requirements, _ := parsed.Requirements()
+	for _, requirement := range requirements {
+		if requirement.Key() == p.Key {
+			return fmt.Errorf("invalid %s value %q: uses PRIMARY_LABEL_KEY %q, which the labeler rewrites", name, selector, p.Key)
+		}
+	}
+	return nil
+}
+
+// String returns the label as key=value for the primary pod.
+func (p PrimaryLabel) String() string {
+	return p.Key + "=" + p.Value
+}
+
+// podChanges returns the label and annotation changes that bring pod to its
+// desired state for top. A label left behind under a previous
+// PRIMARY_LABEL_KEY is removed in the same patch, with ANNOTATE_PODS a role
+// change is stamped with the current time, and with REPLICATION_LAG_THRESHOLD
+// the pod's lag is recorded.
+func (l *Labeler) podChanges(pod *corev1.Pod, top *topology) (labels, annotations map[string]any) {
+	key := l.Config.PrimaryLabel.Key
+	desired := l.desiredLabels(pod.GetName(), top)
+	if previousKey := previousPrimaryLabelKey(pod); previousKey != key {
+		if _, managed := desired[previousKey]; !managed {
+			desired[previousKey] = nil
+		}
+	}
+
+	labels = labelChanges(pod.Labels, desired)
+
+	// The key annotation is only kept for a non-default key: pods labelled
+	// before the key was configurable carry the default key and no annotation.
+	desiredAnnotations := l.desiredAnnotations(top)
+	desiredAnnotations[primaryLabelKeyAnnotation] = nil
+	if key != defaultPrimaryLabel.Key {
+		desiredAnnotations[primaryLabelKeyAnnotation] = key
+	}
+	if l.Config.AnnotatePods && l.roleChanged(labels) {
+		desiredAnnotations[roleChangedAtAnnotation] = roleChangedAt(time.Now())
+	}
+	if l.Config.ReplicationLagThreshold > 0 {
+		desiredAnnotations[replicationLagAnnotation] = lagAnnotation(pod.GetName(), top)
+	}
+	return labels, labelChanges(pod.Annotations, desiredAnnotations)
+}
+
+// previousPrimaryLabelKey returns the primary label key last written to pod.
+func previousPrimaryLabelKey(pod *corev1.Pod) string {
+	if key, ok := pod.Annotations[primaryLabelKeyAnnotation]; ok {
+		return key
+	}
+	return defaultPrimaryLabel.Key
+}
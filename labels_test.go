@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var leaderFollowerLabel = PrimaryLabel{
+	Key:             "mongodb.example.com/role",
+	Value:           "leader",
+	NonPrimaryValue: "follower",
+}
+
+// podMetadata returns the labels and annotations of every pod, keyed by name.
+func podMetadata(t *testing.T, k8sClient *fake.Clientset) (map[string]map[string]string, map[string]map[string]string) {
+	t.Helper()
+
+	list, err := k8sClient.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	labels := map[string]map[string]string{}
+	annotations := map[string]map[string]string{}
+	for _, pod := range list.Items {
+		labels[pod.Name] = pod.Labels
+		annotations[pod.Name] = pod.Annotations
+	}
+	return labels, annotations
+}
+
+func TestPrimaryLabelValidate(t *testing.T) {
+	tests := []struct {
+		name                  string
+		label                 PrimaryLabel
+		expectedErrorContains string
+	}{
+		{name: "default", label: defaultPrimaryLabel},
+		{name: "prefixed key", label: leaderFollowerLabel},
+		{
+			name:  "empty non-primary value",
+			label: PrimaryLabel{Key: "primary", Value: "true"},
+		},
+		{
+			name:                  "invalid key",
+			label:                 PrimaryLabel{Key: "not a key", Value: "true", NonPrimaryValue: "false"},
+			expectedErrorContains: "invalid PRIMARY_LABEL_KEY value",
+		},
+		{
+			name:                  "reserved key",
+			label:                 PrimaryLabel{Key: roleLabel, Value: "true", NonPrimaryValue: "false"},
+			expectedErrorContains: "reserved by the labeler",
+		},
+		{
+			name:                  "empty primary value",
+			label:                 PrimaryLabel{Key: "primary", NonPrimaryValue: "false"},
+			expectedErrorContains: "invalid PRIMARY_LABEL_VALUE value: must not be empty",
+		},
+		{
+			name:                  "invalid non-primary value",
+			label:                 PrimaryLabel{Key: "primary", Value: "true", NonPrimaryValue: "-false"},
+			expectedErrorContains: "invalid NON_PRIMARY_LABEL_VALUE value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.label.validate()
+			if tt.expectedErrorContains != "" {
+				require.ErrorContains(t, err, tt.expectedErrorContains)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSetPrimaryLabel_MigratesLabelKey(t *testing.T) {
+	// Pods labelled by a release with the hardcoded primary=true|false label.
+	k8sClient := newClientsetWithPrimary("default", map[string]string{
+		"mongo-0": "true",
+		"mongo-1": "false",
+	})
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+	labeler.Config.PrimaryLabel = leaderFollowerLabel
+
+	require.NoError(t, labeler.setPrimaryLabel())
+	labels, annotations := podMetadata(t, k8sClient)
+	assert.Equal(t, map[string]map[string]string{
+		"mongo-0": {"role": "mongo", "mongodb.example.com/role": "follower"},
+		"mongo-1": {"role": "mongo", "mongodb.example.com/role": "leader"},
+	}, labels)
+	for pod, podAnnotations := range annotations {
+		assert.Equal(t, "mongodb.example.com/role", podAnnotations[primaryLabelKeyAnnotation], pod)
+	}
+
+	// Converged pods are not patched again.
+	k8sClient.ClearActions()
+	require.NoError(t, labeler.setPrimaryLabel())
+	assert.Empty(t, collectPrimaryPatchValues(t, k8sClient))
+
+	// Switching back to the default key removes the custom key and annotation.
+	labeler.Config.PrimaryLabel = defaultPrimaryLabel
+	require.NoError(t, labeler.setPrimaryLabel())
+	labels, annotations = podMetadata(t, k8sClient)
+	assert.Equal(t, map[string]map[string]string{
+		"mongo-0": {"role": "mongo", "primary": "false"},
+		"mongo-1": {"role": "mongo", "primary": "true"},
+	}, labels)
+	for pod, podAnnotations := range annotations {
+		assert.NotContains(t, podAnnotations, primaryLabelKeyAnnotation, pod)
+	}
+}
+
+func TestSetPrimaryLabel_CustomValuesWithoutLabelAll(t *testing.T) {
+	k8sClient := fake.NewClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "mongo-0",
+			Namespace:   "default",
+			Labels:      map[string]string{"role": "mongo", "mongodb.example.com/role": "leader"},
+			Annotations: map[string]string{primaryLabelKeyAnnotation: "mongodb.example.com/role"},
+		}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "mongo-1",
+			Namespace: "default",
+			Labels:    map[string]string{"role": "mongo"},
+		}},
+	)
+	labeler := newTestLabeler(k8sClient, false, "mongo-1")
+	labeler.Config.PrimaryLabel = leaderFollowerLabel
+
+	require.NoError(t, labeler.setPrimaryLabel())
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, map[string]map[string]string{
+		"mongo-0": {"role": "mongo"},
+		"mongo-1": {"role": "mongo", "mongodb.example.com/role": "leader"},
+	}, labels)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	phuslog "github.com/phuslu/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// lagLabel is written to every data-bearing pod when REPLICATION_LAG_THRESHOLD
+// is set: lagOK while the member is within the threshold of the primary,
+// lagStale when it is behind, unhealthy, or its lag is unknown.
+const (
+	lagLabel                 = "mongo-lag"
+	lagOK                    = "ok"
+	lagStale                 = "stale"
+	replicationLagAnnotation = "mongo-labeler/replication-lag"
+)
+
+// fetchReplSetStatus returns the decoded "replSetGetStatus" command response.
+// The MongoDB user needs the clusterMonitor role.
+func (l *Labeler) fetchReplSetStatus(ctx context.Context) (bson.M, error) {
+	client, err := l.connectMongo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status, err := runAdminCommand(ctx, client, "replSetGetStatus")
+	if err != nil {
+		return nil, fmt.Errorf("run replSetGetStatus command on mongo at %q: %w", l.Config.Address, err)
+	}
+	return status, nil
+}
+
+// resolveLag sets top.Lag from the replSetGetStatus response returned by
+// fetch, mapping members to pods with hosts. A failure is logged rather than
+// failing the reconcile: labelling the primary matters more, and with top.Lag
+// unset every secondary is reported stale, which is the safe side for a
+// Service that selects fresh members.
+func (l *Labeler) resolveLag(ctx context.Context, top *topology, hosts hostMapper, fetch func(context.Context) (bson.M, error)) {
+	status, err := fetch(ctx)
+	if err != nil {
+		mongoErrorsTotal.WithLabelValues(l.Config.Name).Inc()
+		withShard(withReplicaSet(phuslog.Warn(), l.Config.Name), top.Shard).Err(err).Msg("failed to read replication lag, marking secondaries stale")
+		return
+	}
+	top.Lag = parseReplicationLag(status, hosts)
+}
+
+// parseReplicationLag maps pod names to how far their optimeDate is behind the
+// primary's, or behind the most recent member while there is no primary.
+// Only healthy PRIMARY and SECONDARY members are included.
+func parseReplicationLag(status bson.M, hosts hostMapper) map[string]time.Duration {
+	optimes := map[string]time.Time{}
+	var reference time.Time
+	hasPrimary := false
+	members, _ := status["members"].(bson.A)
+	for _, value := range members {
+		member := bsonDocument(value)
+		if health, _ := bsonInt64(member["health"]); health != 1 {
+			continue
+		}
+		state, _ := member["stateStr"].(string)
+		if state != "PRIMARY" && state != "SECONDARY" {
+			continue
+		}
+		name, _ := member["name"].(string)
+		podName := hosts(name)
+		optime, ok := bsonTime(member["optimeDate"])
+		if podName == "" || !ok {
+			continue
+		}
+		optimes[podName] = optime
+		switch {
+		case state == "PRIMARY":
+			reference, hasPrimary = optime, true
+		case !hasPrimary && optime.After(reference):
+			reference = optime
+		}
+	}
+
+	lag := make(map[string]time.Duration, len(optimes))
+	for podName, optime := range optimes {
+		lag[podName] = max(reference.Sub(optime), 0)
+	}
+	return lag
+}
+
+// lagLabelValue returns the lagLabel value for podName, or nil for pods that
+// do not replicate data.
+func (l *Labeler) lagLabelValue(podName string, top *topology) any {
+	if role := top.Roles[podName]; role == roleArbiter || role == roleMongos {
+		return nil
+	}
+	if podName == top.Primary {
+		return lagOK
+	}
+	if lag, ok := top.Lag[podName]; ok && lag <= l.Config.ReplicationLagThreshold {
+		return lagOK
+	}
+	return lagStale
+}
+
+// lagAnnotation returns the replicationLagAnnotation value for podName, or nil
+// when its lag is unknown.
+func lagAnnotation(podName string, top *topology) any {
+	lag, ok := top.Lag[podName]
+	if !ok {
+		return nil
+	}
+	return lag.Round(time.Second).String()
+}
+
+// bsonTime converts a BSON date field to time.Time.
+func bsonTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case bson.DateTime:
+		return v.Time(), true
+	case time.Time:
+		return v, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// statusMember builds a replSetGetStatus member document the way the driver
+// decodes it.
+func statusMember(name, state string, health float64, optime time.Time) bson.D {
+	return bson.D{
+		{Key: "name", Value: name},
+		{Key: "health", Value: health},
+		{Key: "stateStr", Value: state},
+		{Key: "optimeDate", Value: bson.NewDateTimeFromTime(optime)},
+	}
+}
+
+func TestParseReplicationLag(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		members bson.A
+		want    map[string]time.Duration
+	}{
+		{
+			name: "lag behind the primary",
+			members: bson.A{
+				statusMember("mongo-0.mongo:27017", "SECONDARY", 1, now.Add(-3*time.Second)),
+				statusMember("mongo-1.mongo:27017", "PRIMARY", 1, now),
+				statusMember("mongo-2.mongo:27017", "SECONDARY", 1, now.Add(-time.Minute)),
+			},
+			want: map[string]time.Duration{
+				"mongo-0": 3 * time.Second,
+				"mongo-1": 0,
+				"mongo-2": time.Minute,
+			},
+		},
+		{
+			name: "unhealthy, recovering and arbiter members are skipped",
+			members: bson.A{
+				statusMember("mongo-0.mongo:27017", "PRIMARY", 1, now),
+				statusMember("mongo-1.mongo:27017", "(not reachable/healthy)", 0, now.Add(-time.Hour)),
+				statusMember("mongo-2.mongo:27017", "RECOVERING", 1, now.Add(-time.Hour)),
+				statusMember("mongo-3.mongo:27017", "ARBITER", 1, time.Time{}),
+			},
+			want: map[string]time.Duration{"mongo-0": 0},
+		},
+		{
+			name: "no primary uses the most recent member",
+			members: bson.A{
+				statusMember("mongo-0.mongo:27017", "SECONDARY", 1, now.Add(-2*time.Second)),
+				statusMember("mongo-1.mongo:27017", "SECONDARY", 1, now),
+			},
+			want: map[string]time.Duration{
+				"mongo-0": 2 * time.Second,
+				"mongo-1": 0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseReplicationLag(bson.M{"members": tt.members}, podNameFromHost))
+		})
+	}
+}
+
+func TestSetPrimaryLabel_LagLabels(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1", "mongo-2", "mongo-3")
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+	labeler.Config.ReplicationLagThreshold = 10 * time.Second
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{
+			Primary: "mongo-0",
+			Roles:   map[string]string{"mongo-3": roleArbiter},
+			Lag: map[string]time.Duration{
+				"mongo-0": 0,
+				"mongo-1": 2 * time.Second,
+				"mongo-2": time.Minute,
+			},
+		}, nil
+	}
+
+	require.NoError(t, labeler.setPrimaryLabel())
+	labels, annotations := podMetadata(t, k8sClient)
+	assert.Equal(t, lagOK, labels["mongo-0"][lagLabel])
+	assert.Equal(t, lagOK, labels["mongo-1"][lagLabel])
+	assert.Equal(t, lagStale, labels["mongo-2"][lagLabel])
+	assert.NotContains(t, labels["mongo-3"], lagLabel, "arbiters do not replicate data")
+
+	assert.Equal(t, "0s", annotations["mongo-0"][replicationLagAnnotation])
+	assert.Equal(t, "2s", annotations["mongo-1"][replicationLagAnnotation])
+	assert.Equal(t, "1m0s", annotations["mongo-2"][replicationLagAnnotation])
+	assert.NotContains(t, annotations["mongo-3"], replicationLagAnnotation)
+}
+
+func TestGetMongoTopology_LagStatusFailureMarksSecondariesStale(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.topologyResolver = nil
+	labeler.Config.ReplicationLagThreshold = 10 * time.Second
+	labeler.helloFetcher = func(context.Context) (bson.M, error) {
+		return bson.M{"primary": "mongo-0.mongo:27017"}, nil
+	}
+	labeler.statusFetcher = func(context.Context) (bson.M, error) {
+		return nil, errors.New("not authorized on admin to execute command { replSetGetStatus: 1 }")
+	}
+
+	require.NoError(t, labeler.setPrimaryLabel(), "a lag failure does not block primary labelling")
+	labels, annotations := podMetadata(t, k8sClient)
+	assert.Equal(t, "true", labels["mongo-0"]["primary"])
+	assert.Equal(t, lagOK, labels["mongo-0"][lagLabel])
+	assert.Equal(t, lagStale, labels["mongo-1"][lagLabel])
+	assert.NotContains(t, annotations["mongo-1"], replicationLagAnnotation)
+}
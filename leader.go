@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	phuslog "github.com/phuslu/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Lease timings follow the client-go defaults used by kube-controller-manager:
+// a crashed leader is replaced within about leaseDuration.
+const (
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+	leaseRetryPeriod   = 2 * time.Second
+)
+
+// newLeaderElector builds an elector for the LEADER_ELECTION_LEASE_NAME Lease in
+// NAMESPACE. While this sidecar holds the lease l.leading is true and a
+// reconcile is queued on leaderElected; the others stay on hot standby with
+// their informer cache synced so a new leader can act immediately.
+func (l *Labeler) newLeaderElector(identity string) (*leaderelection.LeaderElector, error) {
+	l.leaderElected = make(chan struct{}, 1)
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      l.Config.LeaderElectionLeaseName,
+			Namespace: l.Config.Namespace,
+		},
+		Client:     l.K8sClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            l.Config.LeaderElectionLeaseName,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   leaseRenewDeadline,
+		RetryPeriod:     leaseRetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				withReplicaSet(phuslog.Info(), l.Config.Name).Str("identity", identity).Msg("acquired leader lease")
+				l.leading.Store(true)
+				notify(l.leaderElected)
+			},
+			OnStoppedLeading: func() {
+				if l.leading.Swap(false) {
+					withReplicaSet(phuslog.Info(), l.Config.Name).Str("identity", identity).Msg("lost leader lease, standing by")
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					withReplicaSet(phuslog.Info(), l.Config.Name).Str("leader", leader).Msg("standing by for leader")
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create leader elector for lease %q: %w", l.Config.LeaderElectionLeaseName, err)
+	}
+	return elector, nil
+}
+
+// startLeaderElection campaigns for the LEADER_ELECTION_LEASE_NAME Lease in
+// the background until ctx is cancelled.
+func (l *Labeler) startLeaderElection(ctx context.Context) error {
+	identity, err := leaderIdentity()
+	if err != nil {
+		return err
+	}
+	elector, err := l.newLeaderElector(identity)
+	if err != nil {
+		return err
+	}
+	go campaign(ctx, elector)
+	return nil
+}
+
+// campaign runs the elector until ctx is cancelled. Run returns whenever the
+// lease is lost, so a demoted sidecar goes straight back to standby and keeps
+// campaigning instead of exiting.
+func campaign(ctx context.Context, elector *leaderelection.LeaderElector) {
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+}
+
+// isLeader reports whether this sidecar may write labels: always when leader
+// election is disabled, otherwise only while it holds the lease.
+func (l *Labeler) isLeader() bool {
+	return l.Config.LeaderElectionLeaseName == "" || l.leading.Load()
+}
+
+// leaderIdentity returns the lease holder identity for this sidecar. Inside a
+// pod the hostname is the pod name, which is unique within the StatefulSet.
+func leaderIdentity() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("determine leader election identity: %w", err)
+	}
+	return hostname, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestIsLeader(t *testing.T) {
+	l := &Labeler{Config: &Config{}}
+	assert.True(t, l.isLeader(), "leader election disabled")
+
+	l.Config.LeaderElectionLeaseName = "mongo-labeler"
+	assert.False(t, l.isLeader(), "lease not held")
+
+	l.leading.Store(true)
+	assert.True(t, l.isLeader(), "lease held")
+}
+
+func TestLeaderElection_AcquiresFreeLease(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0")
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+	labeler.Config.LeaderElectionLeaseName = "mongo-labeler"
+
+	elector, err := labeler.newLeaderElector("mongo-0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		campaign(ctx, elector)
+		close(done)
+	}()
+
+	require.Eventually(t, labeler.isLeader, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-labeler.leaderElected:
+	case <-time.After(time.Second):
+		t.Fatal("becoming leader should queue a reconcile")
+	}
+
+	lease, err := k8sClient.CoordinationV1().Leases("default").Get(ctx, "mongo-labeler", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "mongo-0", *lease.Spec.HolderIdentity)
+
+	// Cancelling releases the lease and stops campaigning.
+	cancel()
+	<-done
+	assert.False(t, labeler.isLeader())
+}
+
+func TestLeaderElection_StandsByWhileLeaseHeld(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	now := metav1.NewMicroTime(time.Now())
+	_, err := k8sClient.CoordinationV1().Leases("default").Create(context.Background(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "mongo-labeler", Namespace: "default"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To("mongo-1"),
+			LeaseDurationSeconds: ptr.To(int32(3600)),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	labeler := newTestLabeler(k8sClient, true, "mongo-0")
+	labeler.Config.LeaderElectionLeaseName = "mongo-labeler"
+	elector, err := labeler.newLeaderElector("mongo-0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go campaign(ctx, elector)
+
+	assert.Never(t, labeler.isLeader, 300*time.Millisecond, 10*time.Millisecond)
+}
@@ -2,51 +2,187 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	phuslog "github.com/phuslu/log"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/event"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 type Config struct {
-	LabelSelector     string
-	Namespace         string
-	Address           string
-	LabelAll          bool
-	LogLevel          phuslog.Level
-	K8sRequestTimeout time.Duration
+	LabelSelector           string
+	Namespace               string
+	Address                 string
+	URI                     secret
+	MongoAuth               MongoAuth
+	MongoTLS                MongoTLS
+	PrimaryLabel            PrimaryLabel
+	HostMapping             HostMapping
+	NoPrimaryPolicy         string
+	NoPrimaryGracePeriod    time.Duration
+	LabelAll                bool
+	LabelRoles              bool
+	Sharded                 bool
+	QuorumCheck             bool
+	ElectionFencing         bool
+	AnnotatePods            bool
+	WatchTopology           bool
+	DryRun                  bool
+	ServerSideApply         bool
+	FieldManager            string
+	ForceConflicts          bool
+	LeaderElectionLeaseName string
+	ListenAddress           string
+	// ReplicationLagThreshold enables the mongo-lag label when non-zero.
+	ReplicationLagThreshold time.Duration
+	// ReadinessFailureThreshold and ReadinessMaxStaleness make /readyz fail;
+	// zero disables the respective check.
+	ReadinessFailureThreshold int
+	ReadinessMaxStaleness     time.Duration
+	LogLevel                  phuslog.Level
+	K8sRequestTimeout         time.Duration
+	ReconcileInterval         time.Duration
+	MongoCommandTimeout       time.Duration
+	// Name is the REPLICA_SETS_FILE entry this Config was derived from, and
+	// ReplicaSets the entries themselves; both are empty for a single
+	// replica set.
+	Name        string
+	ReplicaSets []ReplicaSetConfig
 }
 
 type Labeler struct {
-	Config          *Config
-	K8sClient       kubernetes.Interface
-	primaryResolver func() (string, error)
-	helloFetcher    func(ctx context.Context) (bson.M, error)
-	lastPrimary     string
-	mongoClient     *mongo.Client
+	Config           *Config
+	K8sClient        kubernetes.Interface
+	topologyResolver func() (*topology, error)
+	helloFetcher     func(ctx context.Context) (bson.M, error)
+	statusFetcher    func(ctx context.Context) (bson.M, error)
+	// lastPrimary maps each replica set's shard name ("" outside sharded
+	// mode) to its last recorded primary pod.
+	lastPrimary map[string]string
+	// lastElection maps each replica set's shard name to the newest
+	// electionId seen, with ELECTION_FENCING.
+	lastElection map[string]bson.ObjectID
+	// noPrimarySince maps each replica set's shard name to when it was
+	// first seen without a primary, for NO_PRIMARY_POLICY.
+	noPrimarySince map[string]time.Time
+	mongoClient    *mongo.Client
+	// tlsFiles serves the MONGO_TLS_* files when TLS is enabled; tlsRoots is
+	// the CA pool the current clients were built with.
+	tlsFiles *tlsFiles
+	tlsRoots *x509.CertPool
+	// clusterResolver, commandRunner and shardResolver replace the MongoDB
+	// calls of SHARDED mode in tests; shardClients holds one client per
+	// shard replica set.
+	clusterResolver func() (*cluster, error)
+	commandRunner   func(ctx context.Context, database string, command bson.D) (bson.M, error)
+	shardResolver   func(ctx context.Context, shard shardHost, hosts hostMapper) (*topology, error)
+	shardClients    clientPool
+	// configFetcher and memberHelloFetcher replace the replSetGetConfig and
+	// per-member hello of QUORUM_CHECK in tests; memberClients holds one
+	// direct client per member.
+	configFetcher      func(ctx context.Context) (bson.M, error)
+	memberHelloFetcher func(ctx context.Context, host string) (bson.M, error)
+	memberClients      clientPool
+	// topologyChanged is signalled by the driver's SDAM monitor when
+	// WATCH_TOPOLOGY is enabled; it is nil (never ready) otherwise.
+	topologyChanged chan struct{}
+	// podLister and podsChanged are set once startPodInformer has synced.
+	podLister   corev1listers.PodLister
+	podsChanged chan struct{}
+	// leading and leaderElected track the leader election lease when
+	// LEADER_ELECTION_LEASE_NAME is set.
+	leading       atomic.Bool
+	leaderElected chan struct{}
+	// startedAt and lastSuccess (Unix nanoseconds, zero until the first
+	// successful reconcile) back the seconds_since_last_success metric.
+	startedAt   time.Time
+	lastSuccess atomic.Int64
+	// lastAttempt (Unix nanoseconds), consecutiveFailures and awaitingPrimary
+	// (no primary reported yet since startup) back the /healthz and /readyz
+	// probes.
+	lastAttempt         atomic.Int64
+	consecutiveFailures atomic.Int64
+	awaitingPrimary     atomic.Bool
+	// eventRecorder and selfRef (the sidecar's own pod) are set by
+	// startEventRecorder; events are not recorded while they are nil.
+	eventRecorder record.EventRecorder
+	selfRef       *corev1.ObjectReference
+}
+
+// topology is the replica set view derived from a single "hello" response,
+// with every member already mapped to its pod name.
+type topology struct {
+	Primary string
+	Roles   map[string]string
+	// Shard names the replica set in SHARDED mode: the shard name, or
+	// configShardName for the config servers.
+	Shard string
+	// Replica set metadata for ANNOTATE_PODS; zero when not reported.
+	SetName    string
+	SetVersion int64
+	ElectionID bson.ObjectID
+	Term       int64
+	// Lag holds the replication lag of healthy data-bearing members when
+	// REPLICATION_LAG_THRESHOLD is set.
+	Lag map[string]time.Duration
+	// NoPrimary is set on an unresolved replica set whose members answered
+	// but reported no primary; NO_PRIMARY_POLICY decides its primary label.
+	NoPrimary bool
+	// MembersKnown is set once Roles was completed from replSetGetConfig, so
+	// a pod it leaves out is not a member. Otherwise such a pod may be a
+	// hidden member that hello does not list, and its role is left alone.
+	MembersKnown bool
 }
 
 const (
-	defaultK8sRequestTimeout = 10 * time.Second
-	mongoCommandTimeout      = 10 * time.Second
+	defaultK8sRequestTimeout   = 10 * time.Second
+	defaultMongoCommandTimeout = 10 * time.Second
+	// defaultReconcileInterval is the RECONCILE_INTERVAL default when topology
+	// changes are not watched; watchResyncInterval is the slower safety-net
+	// resync used by default when SDAM events drive reconciles.
+	defaultReconcileInterval = 5 * time.Second
+	watchResyncInterval      = 60 * time.Second
+	minReconcileInterval     = time.Second
+	// defaultListenAddress serves /metrics; LISTEN_ADDRESS="" disables it.
+	defaultListenAddress = ":8080"
+)
+
+// roleLabel is the label written to every selected pod when LABEL_ROLES or
+// SHARDED is enabled, holding one of the role* values below. roleMongos is
+// only used in sharded mode.
+const (
+	roleLabel     = "mongo-role"
+	rolePrimary   = "primary"
+	roleSecondary = "secondary"
+	roleArbiter   = "arbiter"
+	roleHidden    = "hidden"
+	roleMongos    = "mongos"
+	roleUnknown   = "unknown"
 )
 
 func configureLogger(level phuslog.Level) phuslog.Logger {
@@ -71,27 +207,81 @@ func New(config *Config) (*Labeler, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Labeler{
+	labeler := &Labeler{
 		Config:    config,
 		K8sClient: k8sClient,
-	}, nil
+		startedAt: time.Now(),
+	}
+	if config.WatchTopology {
+		labeler.topologyChanged = make(chan struct{}, 1)
+	}
+	if config.MongoTLS.Enabled {
+		labeler.tlsFiles = newTLSFiles(config.MongoTLS)
+		if err := labeler.tlsFiles.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return labeler, nil
 }
 
-func (l *Labeler) setPrimaryLabel() error {
-	primaryResolver := l.primaryResolver
-	if primaryResolver == nil {
-		primaryResolver = l.getMongoPrimary
+// reconcile runs setPrimaryLabel, unless this sidecar is a leader election
+// standby, and records its duration and result for metrics and probes.
+func (l *Labeler) reconcile() error {
+	start := time.Now()
+	l.lastAttempt.Store(start.UnixNano())
+	if !l.isLeader() {
+		phuslog.Debug().Msg("not the leader, skipping reconcile")
+		return nil
 	}
-	primaryPodName, err := primaryResolver()
+
+	err := l.setPrimaryLabel()
+	reconcileDuration.WithLabelValues(l.Config.Name).Observe(time.Since(start).Seconds())
 	if err != nil {
-		return fmt.Errorf("resolve primary pod name: %w", err)
+		reconcilesTotal.WithLabelValues(l.Config.Name, "error").Inc()
+		// Until the first success, a replica set without a primary is most
+		// likely not initiated yet, which must not make the pod unready.
+		awaitingPrimary := errors.Is(err, errNoPrimary) && l.lastSuccess.Load() == 0
+		l.awaitingPrimary.Store(awaitingPrimary)
+		if !awaitingPrimary {
+			l.consecutiveFailures.Add(1)
+		}
+		l.recordReconcileFailure(err)
+		return err
+	}
+	reconcilesTotal.WithLabelValues(l.Config.Name, "success").Inc()
+	l.awaitingPrimary.Store(false)
+	l.consecutiveFailures.Store(0)
+	l.lastSuccess.Store(time.Now().UnixNano())
+	return nil
+}
+
+// lastSuccessTime returns when l last reconciled successfully, or when it
+// started if it never has.
+func (l *Labeler) lastSuccessTime() time.Time {
+	if nanos := l.lastSuccess.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return l.startedAt
+}
+
+// podTarget pairs a selected pod with the replica set topology that decides
+// its labels.
+type podTarget struct {
+	pod *corev1.Pod
+	top *topology
+}
+
+func (l *Labeler) setPrimaryLabel() error {
+	sets, others, errs := l.resolveReplicaSets()
+	if len(sets) == 0 {
+		return errors.Join(errs...)
 	}
 
 	listCtx, cancel := context.WithTimeout(context.Background(), l.Config.K8sRequestTimeout)
 	defer cancel()
-	podsClient := l.K8sClient.CoreV1().Pods(l.Config.Namespace)
-	pods, err := podsClient.List(listCtx, metav1.ListOptions{LabelSelector: l.Config.LabelSelector})
+	pods, err := l.listPods(listCtx)
 	if err != nil {
+		kubernetesErrorsTotal.WithLabelValues(l.Config.Name, "list").Inc()
 		return fmt.Errorf(
 			"list pods in namespace %q with selector %q: %w",
 			l.Config.Namespace,
@@ -99,120 +289,314 @@ func (l *Labeler) setPrimaryLabel() error {
 			err,
 		)
 	}
-	phuslog.Debug().Msgf("Found %d pods", len(pods.Items))
-
-	primaryFound := false
-	primaryAlreadyTrue := false
-	for _, pod := range pods.Items {
-		if pod.GetName() == primaryPodName {
-			primaryFound = true
-			primaryAlreadyTrue = pod.Labels["primary"] == "true"
-			break
-		}
-	}
-	if !primaryFound {
-		return fmt.Errorf("primary not found")
-	}
+	phuslog.Debug().Msgf("Found %d pods", len(pods))
 
-	// Demote (or unlabel) every non-primary pod before promoting the primary, so
-	// that during a failover the old primary loses primary=true before the new one
-	// gains it. This favors a brief window with no primary over one with two.
-	for _, pod := range pods.Items {
-		podName := pod.GetName()
-		if podName == primaryPodName {
+	// A replica set whose primary is unknown, is not among the selected pods
+	// or, with ELECTION_FENCING, comes from an older election, is left
+	// untouched, apart from NO_PRIMARY_POLICY; the others are still labelled.
+	resolved := map[*topology]bool{}
+	for _, top := range sets {
+		if top.Primary == "" {
 			continue
 		}
-		removePrimaryLabel := !l.Config.LabelAll
-		currentValue, hasLabel := pod.Labels["primary"]
-
-		// Skip pods already in the desired state to avoid needless PATCH calls.
-		alreadyDesired := (removePrimaryLabel && !hasLabel) || (!removePrimaryLabel && currentValue == "false")
-		if alreadyDesired {
+		l.primaryRecovered(top)
+		found := slices.ContainsFunc(pods, func(pod *corev1.Pod) bool {
+			return pod.GetName() == top.Primary && l.replicaSetOf(pod.GetName(), sets, others) == top
+		})
+		if !found {
+			errs = append(errs, shardError(top.Shard, fmt.Errorf("%w: no pod named %q matches selector %q", errPrimaryNotFound, top.Primary, l.Config.LabelSelector)))
 			continue
 		}
+		if l.Config.ElectionFencing {
+			if err := l.checkElection(top, l.membersOf(top, pods, sets, others)); err != nil {
+				errs = append(errs, shardError(top.Shard, err))
+				continue
+			}
+		}
+		resolved[top] = true
+	}
 
-		// LABEL_ALL=false removes the label (nil); otherwise demote to "false".
-		var desired any
-		if !removePrimaryLabel {
-			desired = "false"
+	var demotions, promotions []podTarget
+	for _, pod := range pods {
+		top := l.replicaSetOf(pod.GetName(), sets, others)
+		switch {
+		case top == nil:
+		case top == others:
+			demotions = append(demotions, podTarget{pod: pod, top: top})
+		case !resolved[top]:
+		case pod.GetName() == top.Primary:
+			promotions = append(promotions, podTarget{pod: pod, top: top})
+		default:
+			demotions = append(demotions, podTarget{pod: pod, top: top})
 		}
-		if err := l.patchPrimaryLabel(podName, desired); err != nil {
+	}
+
+	// Demote (or unlabel) every non-primary pod before promoting the primaries,
+	// so that during a failover the old primary loses primary=true before the new
+	// one gains it. This favors a brief window with no primary over one with two.
+	// Pods already in the desired state are skipped to avoid needless PATCH calls.
+	for _, target := range append(demotions, promotions...) {
+		pod, changes, err := l.updatePod(target.pod, func(pod *corev1.Pod) (map[string]any, map[string]any) {
+			return l.podChanges(pod, target.top)
+		})
+		if err != nil {
 			return err
 		}
+		l.recordPrimaryTransition(pod, changes, target.top.Primary)
 	}
-
-	// Promote the primary last, and only if it is not already labelled.
-	if !primaryAlreadyTrue {
-		if err := l.patchPrimaryLabel(primaryPodName, "true"); err != nil {
+	for _, top := range sets {
+		if !top.NoPrimary {
+			continue
+		}
+		if err := l.applyNoPrimaryPolicy(top, l.membersOf(top, pods, sets, others)); err != nil {
 			return err
 		}
 	}
 
-	// Record the transition only after the primary's label is confirmed (it was
+	// Record a transition only after the primary's label is confirmed (it was
 	// already true, or the promotion patch above succeeded), so a failed promotion
 	// is retried and logged on a later tick rather than being silently recorded.
-	if primaryPodName != l.lastPrimary {
-		if l.lastPrimary == "" {
-			phuslog.Info().Str("pod", primaryPodName).Msg("primary detected")
-		} else {
-			phuslog.Info().Str("from", l.lastPrimary).Str("to", primaryPodName).Msg("primary changed")
+	for _, target := range promotions {
+		l.recordPrimary(target.top)
+	}
+	return errors.Join(errs...)
+}
+
+// resolveReplicaSets returns the replica sets to label: the one behind
+// MONGO_URI, or with SHARDED every shard and the config servers. In sharded
+// mode others holds the roles of the discovered mongos routers, and is nil
+// when there are none. Resolution errors are returned alongside whatever could
+// be resolved.
+func (l *Labeler) resolveReplicaSets() (sets []*topology, others *topology, errs []error) {
+	if !l.Config.Sharded {
+		topologyResolver := l.topologyResolver
+		if topologyResolver == nil {
+			topologyResolver = l.getMongoTopology
+		}
+		top, err := topologyResolver()
+		if err != nil {
+			mongoErrorsTotal.WithLabelValues(l.Config.Name).Inc()
+			err = fmt.Errorf("resolve primary pod name: %w", err)
+			if errors.Is(err, errNoPrimary) {
+				return []*topology{{NoPrimary: true}}, nil, []error{err}
+			}
+			return nil, nil, []error{err}
+		}
+		return []*topology{top}, nil, nil
+	}
+
+	clusterResolver := l.clusterResolver
+	if clusterResolver == nil {
+		clusterResolver = l.getClusterTopology
+	}
+	c, err := clusterResolver()
+	if err != nil {
+		mongoErrorsTotal.WithLabelValues(l.Config.Name).Inc()
+		return nil, nil, []error{fmt.Errorf("resolve sharded cluster: %w", err)}
+	}
+	if len(c.Mongos) > 0 {
+		others = &topology{Roles: map[string]string{}}
+		for _, podName := range c.Mongos {
+			others.Roles[podName] = roleMongos
+		}
+	}
+	return c.ReplicaSets, others, c.Errors
+}
+
+// replicaSetOf returns the topology that decides podName's labels. Outside
+// sharded mode every selected pod belongs to the single replica set. In
+// sharded mode a pod outside every resolved replica set is decided by others
+// only if it is a discovered mongos; otherwise replicaSetOf returns nil and
+// the pod is left alone, as it may belong to a shard this sidecar cannot see.
+func (l *Labeler) replicaSetOf(podName string, sets []*topology, others *topology) *topology {
+	if !l.Config.Sharded {
+		return sets[0]
+	}
+	for _, top := range sets {
+		if _, ok := top.Roles[podName]; ok || podName == top.Primary {
+			return top
+		}
+	}
+	if others != nil {
+		if _, ok := others.Roles[podName]; ok {
+			return others
 		}
-		l.lastPrimary = primaryPodName
 	}
 	return nil
 }
 
-// patchPrimaryLabel applies a strategic-merge patch that sets pod's "primary"
-// label to the given value (or removes it when label is nil), using a fresh
-// per-call timeout so each request has an independent deadline rather than
-// sharing one budget across the whole reconcile.
-func (l *Labeler) patchPrimaryLabel(podName string, label any) error {
-	patchBytes, err := json.Marshal(primaryLabelPatch(label))
+// membersOf returns the pods whose labels top decides.
+func (l *Labeler) membersOf(top *topology, pods []*corev1.Pod, sets []*topology, others *topology) []*corev1.Pod {
+	return slices.DeleteFunc(slices.Clone(pods), func(pod *corev1.Pod) bool {
+		return l.replicaSetOf(pod.GetName(), sets, others) != top
+	})
+}
+
+// recordPrimary logs and counts a new primary of top's replica set.
+func (l *Labeler) recordPrimary(top *topology) {
+	last := l.lastPrimary[top.Shard]
+	if top.Primary == last {
+		return
+	}
+	entry := withShard(withReplicaSet(phuslog.Info(), l.Config.Name), top.Shard)
+	if last == "" {
+		entry.Str("pod", top.Primary).Msg("primary detected")
+	} else {
+		entry.Str("from", last).Str("to", top.Primary).Msg("primary changed")
+		failoversTotal.WithLabelValues(l.Config.Name).Inc()
+	}
+	if l.lastPrimary == nil {
+		l.lastPrimary = map[string]string{}
+	}
+	l.lastPrimary[top.Shard] = top.Primary
+	setPrimaryInfo(l.Config.Name, top.Shard, top.Primary)
+}
+
+// desiredLabels returns the labels podName should carry for the given topology.
+// A nil value means the label must be absent: with LABEL_ALL=false non-primary
+// pods lose the primary label instead of being demoted to the non-primary value.
+func (l *Labeler) desiredLabels(podName string, top *topology) map[string]any {
+	primaryLabel := l.Config.PrimaryLabel
+	labels := map[string]any{}
+	switch {
+	case podName == top.Primary:
+		labels[primaryLabel.Key] = primaryLabel.Value
+	case l.Config.LabelAll:
+		labels[primaryLabel.Key] = primaryLabel.NonPrimaryValue
+	default:
+		labels[primaryLabel.Key] = nil
+	}
+	if l.Config.Sharded {
+		labels[shardLabel] = nil
+		if top.Shard != "" {
+			labels[shardLabel] = top.Shard
+		}
+	}
+	if l.Config.LabelRoles || l.Config.Sharded {
+		role := top.Roles[podName]
+		switch {
+		case podName == top.Primary:
+			role = rolePrimary
+		case role == "" && top.MembersKnown:
+			role = roleUnknown
+		}
+		if role != "" {
+			labels[roleLabel] = role
+		}
+	}
+	if l.Config.ReplicationLagThreshold > 0 {
+		labels[lagLabel] = l.lagLabelValue(podName, top)
+	}
+	return labels
+}
+
+// labelChanges returns the subset of desired that differs from current. A nil
+// desired value is only reported when the label is actually present.
+func labelChanges(current map[string]string, desired map[string]any) map[string]any {
+	changes := map[string]any{}
+	for key, want := range desired {
+		have, ok := current[key]
+		if want == nil {
+			if ok {
+				changes[key] = nil
+			}
+			continue
+		}
+		if !ok || have != want {
+			changes[key] = want
+		}
+	}
+	return changes
+}
+
+// patchPrimaryLabel sets pod's labels and annotations to the given values,
+// removing those whose value is nil: with a strategic-merge patch, or with
+// SERVER_SIDE_APPLY an apply request. The request is conditional on pod's
+// resourceVersion, so it fails with a conflict if the pod changed since it
+// was read.
+func (l *Labeler) patchPrimaryLabel(pod *corev1.Pod, labels, annotations map[string]any) error {
+	if l.Config.ServerSideApply {
+		return l.applyPrimaryLabel(pod, labels, annotations)
+	}
+	_, err := l.sendPatch(pod, types.StrategicMergePatchType, primaryLabelPatch(pod.GetResourceVersion(), labels, annotations), labels, annotations)
+	return err
+}
+
+// sendPatch sends patch to pod as FIELD_MANAGER, using a fresh per-call
+// timeout so each request has an independent deadline rather than sharing one
+// budget across the whole reconcile. labels and annotations are the changes
+// the patch makes, for the DRY_RUN log. It returns the patched pod, or pod
+// itself with DRY_RUN.
+func (l *Labeler) sendPatch(pod *corev1.Pod, patchType types.PatchType, patch map[string]any, labels, annotations map[string]any) (*corev1.Pod, error) {
+	podName := pod.GetName()
+	patchBytes, err := json.Marshal(patch)
 	if err != nil {
-		return fmt.Errorf("marshal primary label patch for pod %q: %w", podName, err)
+		return nil, fmt.Errorf("marshal primary label patch for pod %q: %w", podName, err)
+	}
+	if l.Config.DryRun {
+		l.logDryRunPatch(pod, labels, annotations, patchBytes)
+		patchesTotal.WithLabelValues(l.Config.Name, patchOutcomeDryRun).Inc()
+		return pod, nil
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), l.Config.K8sRequestTimeout)
 	defer cancel()
 
+	opts := metav1.PatchOptions{FieldManager: l.Config.FieldManager}
+	if patchType == types.ApplyPatchType {
+		opts.Force = &l.Config.ForceConflicts
+	}
 	phuslog.Debug().Msgf("Patching pod %s with: %s", podName, string(patchBytes))
-	_, err = l.K8sClient.CoreV1().Pods(l.Config.Namespace).Patch(
-		ctx,
-		podName,
-		types.StrategicMergePatchType,
-		patchBytes,
-		metav1.PatchOptions{},
-	)
-	if err != nil {
-		return fmt.Errorf("patch pod %q primary label: %w", podName, err)
+	patched, err := l.K8sClient.CoreV1().Pods(l.Config.Namespace).Patch(ctx, podName, patchType, patchBytes, opts)
+	switch {
+	case isResourceVersionConflict(err):
+		patchesTotal.WithLabelValues(l.Config.Name, patchOutcomeConflict).Inc()
+		return nil, fmt.Errorf("patch pod %q primary label: %w", podName, err)
+	case err != nil:
+		patchesTotal.WithLabelValues(l.Config.Name, patchOutcomeError).Inc()
+		kubernetesErrorsTotal.WithLabelValues(l.Config.Name, "patch").Inc()
+		return nil, fmt.Errorf("patch pod %q primary label: %w", podName, err)
 	}
-	return nil
+	patchesTotal.WithLabelValues(l.Config.Name, patchOutcomeSuccess).Inc()
+	return patched, nil
 }
 
-// primaryLabelPatch builds a strategic-merge patch that sets the "primary" label
-// to the given value, or removes it (null patch) when label is nil.
-func primaryLabelPatch(label any) map[string]any {
+// primaryLabelPatch builds a strategic-merge patch that sets the given labels
+// and annotations, removing (null patch) those whose value is nil. A non-empty
+// resourceVersion makes the patch conditional on it.
+func primaryLabelPatch(resourceVersion string, labels, annotations map[string]any) map[string]any {
+	metadata := map[string]any{
+		"labels": labels,
+	}
+	if resourceVersion != "" {
+		metadata["resourceVersion"] = resourceVersion
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
 	return map[string]any{
-		"metadata": map[string]any{
-			"labels": map[string]any{
-				"primary": label,
-			},
-		},
+		"metadata": metadata,
 	}
 }
 
 func getConfigFromEnvironment() (*Config, error) {
+	replicaSetsPath := envString("REPLICA_SETS_FILE", "")
 	labelSelector, ok := os.LookupEnv("LABEL_SELECTOR")
-	if !ok {
+	if !ok && replicaSetsPath == "" {
 		return nil, fmt.Errorf("please export LABEL_SELECTOR")
 	}
 
 	config := &Config{
-		LabelSelector:     labelSelector,
-		Namespace:         envString("NAMESPACE", "default"),
-		Address:           envString("MONGO_ADDRESS", "localhost:27017"),
-		LogLevel:          phuslog.InfoLevel,
-		K8sRequestTimeout: defaultK8sRequestTimeout,
+		LabelSelector:           labelSelector,
+		Namespace:               envString("NAMESPACE", "default"),
+		LeaderElectionLeaseName: envString("LEADER_ELECTION_LEASE_NAME", ""),
+		ListenAddress:           envString("LISTEN_ADDRESS", defaultListenAddress),
+		LogLevel:                phuslog.InfoLevel,
+		K8sRequestTimeout:       defaultK8sRequestTimeout,
+	}
+
+	if err := setMongoURIFromEnvironment(config); err != nil {
+		return nil, err
 	}
 
 	labelAll, err := envBool("LABEL_ALL", false)
@@ -221,6 +605,133 @@ func getConfigFromEnvironment() (*Config, error) {
 	}
 	config.LabelAll = labelAll
 
+	mongoAuth, err := getMongoAuthFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	config.MongoAuth = mongoAuth
+
+	mongoTLS, err := getMongoTLSFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	config.MongoTLS = mongoTLS
+
+	primaryLabel, err := getPrimaryLabelFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	config.PrimaryLabel = primaryLabel
+	if err := primaryLabel.validateSelector("LABEL_SELECTOR", labelSelector); err != nil {
+		return nil, err
+	}
+
+	hostMapping, err := getHostMappingFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	config.HostMapping = hostMapping
+
+	noPrimaryPolicy, noPrimaryGracePeriod, err := getNoPrimaryPolicyFromEnvironment(primaryLabel)
+	if err != nil {
+		return nil, err
+	}
+	config.NoPrimaryPolicy = noPrimaryPolicy
+	config.NoPrimaryGracePeriod = noPrimaryGracePeriod
+
+	labelRoles, err := envBool("LABEL_ROLES", false)
+	if err != nil {
+		return nil, err
+	}
+	config.LabelRoles = labelRoles
+
+	sharded, err := envBool("SHARDED", false)
+	if err != nil {
+		return nil, err
+	}
+	config.Sharded = sharded
+
+	quorumCheck, err := envBool("QUORUM_CHECK", false)
+	if err != nil {
+		return nil, err
+	}
+	config.QuorumCheck = quorumCheck
+
+	electionFencing, err := envBool("ELECTION_FENCING", false)
+	if err != nil {
+		return nil, err
+	}
+	config.ElectionFencing = electionFencing
+
+	annotatePods, err := envBool("ANNOTATE_PODS", false)
+	if err != nil {
+		return nil, err
+	}
+	config.AnnotatePods = annotatePods
+
+	lagThreshold, err := envDuration("REPLICATION_LAG_THRESHOLD", 0)
+	if err != nil {
+		return nil, err
+	}
+	if lagThreshold < 0 {
+		return nil, fmt.Errorf("invalid REPLICATION_LAG_THRESHOLD value %s: must not be negative", lagThreshold)
+	}
+	config.ReplicationLagThreshold = lagThreshold
+
+	watchTopology, err := envBool("WATCH_TOPOLOGY", false)
+	if err != nil {
+		return nil, err
+	}
+	config.WatchTopology = watchTopology
+
+	defaultInterval := defaultReconcileInterval
+	if watchTopology {
+		defaultInterval = watchResyncInterval
+	}
+	interval, err := envDuration("RECONCILE_INTERVAL", defaultInterval)
+	if err != nil {
+		return nil, err
+	}
+	if interval < minReconcileInterval {
+		return nil, fmt.Errorf("invalid RECONCILE_INTERVAL value %s: must be at least %s", interval, minReconcileInterval)
+	}
+	config.ReconcileInterval = interval
+
+	// The timeout is not bounded by the interval: reconciles never overlap, so
+	// a slow MongoDB call only delays the next one.
+	mongoTimeout, err := envDuration("MONGO_COMMAND_TIMEOUT", defaultMongoCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if mongoTimeout <= 0 {
+		return nil, fmt.Errorf("invalid MONGO_COMMAND_TIMEOUT value %s: must be positive", mongoTimeout)
+	}
+	config.MongoCommandTimeout = mongoTimeout
+
+	dryRun, err := envBool("DRY_RUN", false)
+	if err != nil {
+		return nil, err
+	}
+	config.DryRun = dryRun
+
+	serverSideApply, err := envBool("SERVER_SIDE_APPLY", false)
+	if err != nil {
+		return nil, err
+	}
+	config.ServerSideApply = serverSideApply
+
+	fieldManager, err := getFieldManagerFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	config.FieldManager = fieldManager
+
+	forceConflicts, err := envBool("FORCE_CONFLICTS", true)
+	if err != nil {
+		return nil, err
+	}
+	config.ForceConflicts = forceConflicts
+
 	debug, err := envBool("DEBUG", false)
 	if err != nil {
 		return nil, err
@@ -229,15 +740,150 @@ func getConfigFromEnvironment() (*Config, error) {
 		config.LogLevel = phuslog.DebugLevel
 	}
 
+	failureThreshold, err := envInt("READINESS_FAILURE_THRESHOLD", defaultReadinessFailureThreshold)
+	if err != nil {
+		return nil, err
+	}
+	if failureThreshold < 0 {
+		return nil, fmt.Errorf("invalid READINESS_FAILURE_THRESHOLD value %d: must not be negative", failureThreshold)
+	}
+	config.ReadinessFailureThreshold = failureThreshold
+
+	maxStaleness, err := envDuration("READINESS_MAX_STALENESS", defaultReadinessMaxStaleness)
+	if err != nil {
+		return nil, err
+	}
+	if maxStaleness < 0 {
+		return nil, fmt.Errorf("invalid READINESS_MAX_STALENESS value %s: must not be negative", maxStaleness)
+	}
+	config.ReadinessMaxStaleness = maxStaleness
+
 	timeout, err := envDuration("K8S_REQUEST_TIMEOUT", defaultK8sRequestTimeout)
 	if err != nil {
 		return nil, err
 	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid K8S_REQUEST_TIMEOUT value %s: must be positive", timeout)
+	}
 	config.K8sRequestTimeout = timeout
 
+	if replicaSetsPath != "" {
+		replicaSets, err := loadReplicaSetsFile(replicaSetsPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, rs := range replicaSets {
+			if rs.LabelSelector == "" && labelSelector == "" {
+				return nil, fmt.Errorf("replica set %q in REPLICA_SETS_FILE has no labelSelector and LABEL_SELECTOR is not set", rs.Name)
+			}
+			if err := primaryLabel.validateSelector(fmt.Sprintf("labelSelector of replica set %q", rs.Name), rs.LabelSelector); err != nil {
+				return nil, err
+			}
+		}
+		config.ReplicaSets = replicaSets
+	}
+
 	return config, nil
 }
 
+// setMongoURIFromEnvironment sets the MongoDB endpoint from either MONGO_URI, a
+// full connection string, or the legacy MONGO_ADDRESS host:port. Address always
+// holds the host list without credentials, for logs and error messages, and
+// the connection string is validated here so that a typo fails startup.
+func setMongoURIFromEnvironment(config *Config) error {
+	uri, hasURI := os.LookupEnv("MONGO_URI")
+	address, hasAddress := os.LookupEnv("MONGO_ADDRESS")
+	switch {
+	case hasURI && hasAddress:
+		return fmt.Errorf("set only one of MONGO_URI and MONGO_ADDRESS")
+	case hasURI:
+		config.URI = secret(uri)
+		config.Address = mongoURIHosts(uri)
+	case hasAddress:
+		config.Address = address
+	default:
+		config.Address = "localhost:27017"
+	}
+
+	if err := validateMongoURI(config.mongoURI()); err != nil {
+		if hasURI {
+			return fmt.Errorf("invalid MONGO_URI for %q: %w", config.Address, err)
+		}
+		return fmt.Errorf("invalid MONGO_ADDRESS value %q: %w", config.Address, err)
+	}
+	return nil
+}
+
+// mongoURI returns the connection string to dial: MONGO_URI when set,
+// otherwise a single-host URI built from MONGO_ADDRESS.
+func (c *Config) mongoURI() string {
+	if c.URI != "" {
+		return string(c.URI)
+	}
+	return "mongodb://" + c.Address
+}
+
+// mongoURIHosts returns the comma-separated host list of a connection string,
+// dropping the scheme, any credentials, the database and the options.
+func mongoURIHosts(uri string) string {
+	_, hosts, _ := strings.Cut(uri, "://")
+	hosts, _, _ = strings.Cut(hosts, "/")
+	hosts, _, _ = strings.Cut(hosts, "?")
+	if i := strings.LastIndex(hosts, "@"); i >= 0 {
+		hosts = hosts[i+1:]
+	}
+	return hosts
+}
+
+// validateMongoURI checks the syntax and options of a connection string. The
+// SRV and TXT records of a mongodb+srv:// URI are not resolved: that is left
+// to mongo.Connect, so a transient DNS failure does not fail startup or
+// --print-config.
+func validateMongoURI(uri string) error {
+	uri, err := withoutSRV(uri)
+	if err != nil {
+		return err
+	}
+	return options.Client().ApplyURI(uri).Validate()
+}
+
+// withoutSRV rewrites a mongodb+srv:// connection string as a mongodb:// one
+// for the same host, so it can be parsed without resolving the SRV and TXT
+// records. TLS stays on unless the URI turns it off, as for SRV, and the
+// srvServiceName and srvMaxHosts options, which only apply to the lookup,
+// are dropped. Other connection strings are returned unchanged.
+func withoutSRV(uri string) (string, error) {
+	rest, ok := strings.CutPrefix(uri, "mongodb+srv://")
+	if !ok {
+		return uri, nil
+	}
+	if host := mongoURIHosts(uri); host == "" || strings.ContainsAny(host, ",:") {
+		return "", fmt.Errorf("a mongodb+srv URI must name a single host without a port, got %q", host)
+	}
+	rest, query, _ := strings.Cut(rest, "?")
+	var params []string
+	tlsSet := false
+	for param := range strings.SplitSeq(query, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		switch strings.ToLower(key) {
+		case "":
+			continue
+		case "srvservicename", "srvmaxhosts":
+			continue
+		case "tls", "ssl":
+			tlsSet = true
+		}
+		params = append(params, param)
+	}
+	if !tlsSet {
+		params = append(params, "tls=true")
+	}
+	if !strings.Contains(rest, "/") {
+		rest += "/"
+	}
+	return "mongodb://" + rest + "?" + strings.Join(params, "&"), nil
+}
+
 // envString returns the value of the environment variable key, or def if unset.
 func envString(key, def string) string {
 	if v, ok := os.LookupEnv(key); ok {
@@ -272,6 +918,19 @@ func envDuration(key string, def time.Duration) (time.Duration, error) {
 	return parsed, nil
 }
 
+// envInt parses an integer environment variable, returning def if unset.
+func envInt(key string, def int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q: %w", key, v, err)
+	}
+	return parsed, nil
+}
+
 func getKubeClientSet() (*kubernetes.Clientset, error) {
 	if _, ok := os.LookupEnv("KUBERNETES_SERVICE_HOST"); ok {
 		config, err := rest.InClusterConfig()
@@ -299,19 +958,16 @@ func getKubeClientSet() (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(config)
 }
 
-// kubeconfigFlag parses the optional --kubeconfig flag from the process
-// arguments using a local flag set, so it does not mutate the global
-// flag.CommandLine and is safe to call more than once. A malformed invocation
-// (an unknown flag, or --kubeconfig without a value) returns an error so the
-// sidecar fails fast rather than silently falling back to the default kubeconfig.
+// kubeconfigFlag returns the --kubeconfig flag from the process arguments, or
+// defaultPath when it is not given. A malformed invocation returns an error so
+// the sidecar fails fast rather than silently falling back to the default
+// kubeconfig.
 func kubeconfigFlag(defaultPath string) (string, error) {
-	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-	kubeconfig := fs.String("kubeconfig", defaultPath, "(optional) absolute path to the kubeconfig file")
-	if err := fs.Parse(os.Args[1:]); err != nil {
-		return "", fmt.Errorf("parse command-line flags: %w", err)
+	cmd, err := parseCommandLine(os.Args[1:], defaultPath)
+	if err != nil {
+		return "", err
 	}
-	return *kubeconfig, nil
+	return cmd.kubeconfig, nil
 }
 
 func homeDir() string {
@@ -321,37 +977,96 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
-// getMongoPrimary resolves the primary pod name from MongoDB by fetching the
-// "hello" command response and parsing it. The fetch step is pluggable via
-// helloFetcher (defaulting to fetchHello) so the parsing/orchestration can be
-// tested without a live MongoDB.
-func (l *Labeler) getMongoPrimary() (string, error) {
+// getMongoTopology resolves the primary pod name and member roles from MongoDB
+// by fetching the "hello" command response and parsing it. The fetch step is
+// pluggable via helloFetcher (defaulting to fetchHello) so the
+// parsing/orchestration can be tested without a live MongoDB.
+func (l *Labeler) getMongoTopology() (*topology, error) {
 	fetch := l.helloFetcher
 	if fetch == nil {
 		fetch = l.fetchHello
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), mongoCommandTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), l.Config.MongoCommandTimeout)
 	defer cancel()
 
 	hello, err := fetch(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return parsePrimaryPodName(hello)
+	if msg, _ := hello["msg"].(string); msg == mongosHelloMsg {
+		return nil, fmt.Errorf("mongo at %q is a mongos router, set SHARDED=true", l.Config.Address)
+	}
+	if l.Config.QuorumCheck {
+		configFetcher := l.configFetcher
+		if configFetcher == nil {
+			configFetcher = l.fetchReplSetConfig
+		}
+		if hello, err = l.confirmPrimary(ctx, hello, configFetcher); err != nil {
+			return nil, err
+		}
+	}
+	hosts, err := l.hostMapper(ctx)
+	if err != nil {
+		return nil, err
+	}
+	top, err := parseTopology(hello, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if l.Config.LabelRoles {
+		configFetcher := l.configFetcher
+		if configFetcher == nil {
+			configFetcher = l.fetchReplSetConfig
+		}
+		l.resolveMemberRoles(ctx, top, hosts, configFetcher)
+	}
+	if l.Config.ReplicationLagThreshold > 0 {
+		statusFetcher := l.statusFetcher
+		if statusFetcher == nil {
+			statusFetcher = l.fetchReplSetStatus
+		}
+		l.resolveLag(ctx, top, hosts, statusFetcher)
+	}
+	return top, nil
 }
 
-// fetchHello lazily connects a single long-lived MongoDB client on first use and
-// reuses it on every subsequent tick (the mongo-driver Client is concurrency-safe
-// and pools connections, so reconnecting each tick is wasteful), then returns the
-// decoded "hello" command response.
+// fetchHello returns the decoded "hello" command response.
 func (l *Labeler) fetchHello(ctx context.Context) (bson.M, error) {
+	client, err := l.connectMongo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hello, err := runAdminCommand(ctx, client, "hello")
+	if err != nil {
+		return nil, fmt.Errorf("run hello command on mongo at %q: %w", l.Config.Address, err)
+	}
+	return hello, nil
+}
+
+// runAdminCommand runs a command that takes no arguments, such as hello, on
+// the admin database and returns the decoded response.
+func runAdminCommand(ctx context.Context, client *mongo.Client, command string) (bson.M, error) {
+	var response bson.M
+	if err := client.Database("admin").
+		RunCommand(ctx, bson.D{{Key: command, Value: 1}}).
+		Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// connectMongo lazily connects a single long-lived MongoDB client on first use
+// and reuses it on every subsequent tick (the mongo-driver Client is
+// concurrency-safe and pools connections, so reconnecting each tick is
+// wasteful), and pings it.
+func (l *Labeler) connectMongo(ctx context.Context) (*mongo.Client, error) {
+	l.reconnectOnCARotation(ctx)
 	if l.mongoClient == nil {
-		clientOptions := options.Client().
-			ApplyURI("mongodb://" + l.Config.Address).
-			SetDirect(true).
-			SetMinPoolSize(1).
-			SetMaxPoolSize(1)
+		clientOptions := l.mongoClientOptions()
+		if useDirectConnection(l.Config.mongoURI(), clientOptions) {
+			clientOptions.SetDirect(true)
+		}
 		client, err := mongo.Connect(clientOptions)
 		if err != nil {
 			return nil, fmt.Errorf("connect to mongo at %q: %w", l.Config.Address, err)
@@ -362,19 +1077,166 @@ func (l *Labeler) fetchHello(ctx context.Context) (bson.M, error) {
 	if err := l.mongoClient.Ping(ctx, nil); err != nil {
 		return nil, fmt.Errorf("ping mongo at %q: %w", l.Config.Address, err)
 	}
+	return l.mongoClient, nil
+}
 
-	var hello bson.M
-	if err := l.mongoClient.Database("admin").
-		RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).
-		Decode(&hello); err != nil {
-		return nil, fmt.Errorf("run hello command on mongo at %q: %w", l.Config.Address, err)
+// mongoClientOptions returns the options shared by every MongoDB client: the
+// configured connection string, credentials, TLS and, with WATCH_TOPOLOGY, the
+// SDAM monitor.
+func (l *Labeler) mongoClientOptions() *options.ClientOptions {
+	return l.uriClientOptions(l.Config.mongoURI())
+}
+
+// uriClientOptions is mongoClientOptions for the connection string uri.
+func (l *Labeler) uriClientOptions(uri string) *options.ClientOptions {
+	clientOptions := options.Client().
+		ApplyURI(uri).
+		SetMinPoolSize(1).
+		SetMaxPoolSize(1)
+	if l.Config.MongoAuth.enabled() {
+		clientOptions.SetAuth(l.Config.MongoAuth.credential())
 	}
-	return hello, nil
+	if l.Config.MongoTLS.Enabled {
+		clientOptions.SetTLSConfig(l.tlsFiles.tlsConfig())
+	}
+	if l.Config.WatchTopology {
+		clientOptions.SetServerMonitor(&event.ServerMonitor{
+			ServerDescriptionChanged: l.onServerDescriptionChanged,
+		})
+	}
+	return clientOptions
+}
+
+// hostClientOptions returns the options of a client for hosts rather than the
+// hosts of MONGO_URI, as used for shards and quorum members: the credentials,
+// TLS, app name, timeouts and SDAM monitor of mongoClientOptions on fresh
+// options. Carrying over the connection string itself would keep its
+// replicaSet, and for a mongodb+srv:// URI its SRV scheme, which the driver
+// refuses for a direct connection; its SRV record is not resolved either.
+func (l *Labeler) hostClientOptions(hosts []string) (*options.ClientOptions, error) {
+	uri, err := withoutSRV(l.Config.mongoURI())
+	if err != nil {
+		return nil, err
+	}
+	base := l.uriClientOptions(uri)
+	if err := base.Validate(); err != nil {
+		return nil, err
+	}
+	clientOptions := options.Client().
+		SetHosts(hosts).
+		SetMinPoolSize(1).
+		SetMaxPoolSize(1)
+	clientOptions.Auth = base.Auth
+	clientOptions.TLSConfig = base.TLSConfig
+	clientOptions.ServerMonitor = base.ServerMonitor
+	clientOptions.AppName = base.AppName
+	clientOptions.ConnectTimeout = base.ConnectTimeout
+	clientOptions.ServerSelectionTimeout = base.ServerSelectionTimeout
+	clientOptions.Compressors = base.Compressors
+	return clientOptions, nil
+}
+
+// clientPool holds long-lived MongoDB clients by key, connecting each on
+// first use. Its zero value is empty and ready to use.
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[string]*mongo.Client
+}
+
+// get returns the client for key, connecting it with the options returned by
+// clientOptions if there is none yet.
+func (p *clientPool) get(key string, clientOptions func() (*options.ClientOptions, error)) (*mongo.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[key]; ok {
+		return client, nil
+	}
+	opts, err := clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(opts)
+	if err != nil {
+		return nil, err
+	}
+	if p.clients == nil {
+		p.clients = map[string]*mongo.Client{}
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+// close disconnects every client of the pool.
+func (p *clientPool) close(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, client := range p.clients {
+		if err := client.Disconnect(ctx); err != nil {
+			phuslog.Debug().Msgf("unable to close mongo connection to %s: %v", key, err)
+		}
+	}
+	p.clients = nil
+}
+
+// useDirectConnection reports whether to talk to the single configured host
+// directly, as the sidecar always did with MONGO_ADDRESS, rather than
+// discovering the replica set. It is only used when the connection string
+// names exactly one non-SRV host and sets neither directConnection nor
+// replicaSet, so an explicit choice in MONGO_URI is left to the driver.
+func useDirectConnection(uri string, opts *options.ClientOptions) bool {
+	return !strings.HasPrefix(uri, "mongodb+srv://") &&
+		len(opts.Hosts) == 1 &&
+		opts.Direct == nil &&
+		opts.ReplicaSet == nil
+}
+
+// onServerDescriptionChanged is the driver's SDAM callback. It runs on a driver
+// monitoring goroutine, so it only wakes the reconcile loop and never does the
+// reconcile itself.
+func (l *Labeler) onServerDescriptionChanged(e *event.ServerDescriptionChangedEvent) {
+	if !serverTopologyChanged(e.PreviousDescription, e.NewDescription) {
+		return
+	}
+	phuslog.Debug().
+		Str("address", e.Address.String()).
+		Str("kind", e.NewDescription.Kind).
+		Str("primary", e.NewDescription.Primary.String()).
+		Msg("mongo topology changed")
+	l.notifyTopologyChange()
+}
+
+// notifyTopologyChange queues a reconcile for a topology change.
+func (l *Labeler) notifyTopologyChange() {
+	notify(l.topologyChanged)
+}
+
+// notify queues a reconcile on ch without blocking. Each channel holds a single
+// pending signal, so a burst of events collapses into one reconcile. Sending on
+// a nil channel is a no-op.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// serverTopologyChanged reports whether a server description change can affect
+// the labels: a different server kind (e.g. RSPrimary to RSSecondary), a
+// different primary, a new election or a changed member list.
+func serverTopologyChanged(prev, next event.ServerDescription) bool {
+	return prev.Kind != next.Kind ||
+		prev.Primary != next.Primary ||
+		prev.ElectionID != next.ElectionID ||
+		!slices.Equal(prev.Hosts, next.Hosts) ||
+		!slices.Equal(prev.Passives, next.Passives) ||
+		!slices.Equal(prev.Arbiters, next.Arbiters)
 }
 
 // closeMongo disconnects the long-lived MongoDB client if one was created. It is
 // safe to call when no client exists and is intended for graceful shutdown.
 func (l *Labeler) closeMongo(ctx context.Context) {
+	l.shardClients.close(ctx)
+	l.memberClients.close(ctx)
 	if l.mongoClient == nil {
 		return
 	}
@@ -390,73 +1252,350 @@ func (l *Labeler) closeMongo(ctx context.Context) {
 // host is expected to be a "host:port" value whose host is a Kubernetes DNS name
 // (e.g. mongo-0.mongo.default.svc.cluster.local); the pod name is the first
 // dot-separated label.
-func parsePrimaryPodName(hello bson.M) (string, error) {
-	primaryHost, _ := hello["primary"].(string)
+func parsePrimaryPodName(hello bson.M, hosts hostMapper) (string, error) {
+	primaryHost := helloPrimaryHost(hello)
 	if primaryHost == "" {
-		if isWritablePrimary, ok := hello["isWritablePrimary"].(bool); ok && isWritablePrimary {
-			primaryHost, _ = hello["me"].(string)
-		} else if isMaster, ok := hello["ismaster"].(bool); ok && isMaster {
-			primaryHost, _ = hello["me"].(string)
-		}
+		return "", fmt.Errorf("invalid primary host %q: %w", primaryHost, errNoPrimary)
 	}
-	host, _, err := net.SplitHostPort(primaryHost)
-	if err != nil {
+	if _, _, err := net.SplitHostPort(primaryHost); err != nil {
 		return "", fmt.Errorf("invalid primary host %q: %w", primaryHost, err)
 	}
-	primaryPodName, _, _ := strings.Cut(host, ".")
-	if primaryPodName != "" {
+	if primaryPodName := hosts(primaryHost); primaryPodName != "" {
 		return primaryPodName, nil
 	}
-	return "", fmt.Errorf("unable to derive primary pod name from host %q", host)
+	return "", fmt.Errorf("unable to derive primary pod name from host %q", primaryHost)
+}
+
+// helloPrimaryHost returns the "host:port" of the primary named in a hello
+// response: the "primary" field, or "me" when the responding node is itself
+// the primary.
+func helloPrimaryHost(hello bson.M) string {
+	if primaryHost, _ := hello["primary"].(string); primaryHost != "" {
+		return primaryHost
+	}
+	if helloIsWritablePrimary(hello) {
+		me, _ := hello["me"].(string)
+		return me
+	}
+	return ""
+}
+
+// helloIsWritablePrimary reports whether the node that sent hello is the
+// primary, through isWritablePrimary or the legacy ismaster field.
+func helloIsWritablePrimary(hello bson.M) bool {
+	if isWritablePrimary, ok := hello["isWritablePrimary"].(bool); ok {
+		return isWritablePrimary
+	}
+	isMaster, _ := hello["ismaster"].(bool)
+	return isMaster
+}
+
+// parseTopology builds the replica set view from a "hello" response: the
+// primary pod plus a role for every member the node knows about.
+func parseTopology(hello bson.M, hosts hostMapper) (*topology, error) {
+	primaryPodName, err := parsePrimaryPodName(hello, hosts)
+	if err != nil {
+		return nil, err
+	}
+	top := &topology{Primary: primaryPodName, Roles: parseMemberRoles(hello, primaryPodName, hosts)}
+	parseReplicaSetInfo(hello, top)
+	return top, nil
+}
+
+// parseMemberRoles maps pod names to roles using the member lists of a "hello"
+// response: "hosts" holds electable members, "passives" priority-0 members and
+// "arbiters" arbiters. Hidden members never appear in those lists, so the only
+// one that can be identified is the responding node itself ("me" with
+// "hidden": true). Hosts that cannot be mapped to a pod name are ignored.
+func parseMemberRoles(hello bson.M, primaryPodName string, hosts hostMapper) map[string]string {
+	roles := map[string]string{}
+	assign := func(field, role string) {
+		for _, host := range helloStrings(hello, field) {
+			if podName := hosts(host); podName != "" {
+				roles[podName] = role
+			}
+		}
+	}
+	assign("hosts", roleSecondary)
+	assign("passives", roleSecondary)
+	assign("arbiters", roleArbiter)
+	if hidden, _ := hello["hidden"].(bool); hidden {
+		me, _ := hello["me"].(string)
+		if podName := hosts(me); podName != "" {
+			roles[podName] = roleHidden
+		}
+	}
+	if primaryPodName != "" {
+		roles[primaryPodName] = rolePrimary
+	}
+	return roles
+}
+
+// resolveMemberRoles completes top.Roles with the hidden members and arbiters
+// of the replSetGetConfig response returned by fetch, which hello leaves out
+// or lists only from the hidden node itself. Without it every sidecar but the
+// hidden member's own would disagree on that pod's role. A failure is logged
+// rather than failing the reconcile, and pods hello does not list then keep
+// their role.
+func (l *Labeler) resolveMemberRoles(ctx context.Context, top *topology, hosts hostMapper, fetch func(context.Context) (bson.M, error)) {
+	config, err := fetch(ctx)
+	if err != nil {
+		mongoErrorsTotal.WithLabelValues(l.Config.Name).Inc()
+		withShard(withReplicaSet(phuslog.Warn(), l.Config.Name), top.Shard).Err(err).Msg("failed to read the replica set members, leaving roles of unlisted pods unchanged")
+		return
+	}
+	for podName, role := range parseConfigRoles(config, hosts) {
+		if podName != top.Primary {
+			top.Roles[podName] = role
+		}
+	}
+	top.MembersKnown = true
+}
+
+// parseConfigRoles maps the pods of the members in a replSetGetConfig response
+// to roleHidden, roleArbiter or roleSecondary.
+func parseConfigRoles(response bson.M, hosts hostMapper) map[string]string {
+	config := bsonDocument(response["config"])
+	members, _ := config["members"].(bson.A)
+	roles := map[string]string{}
+	for _, value := range members {
+		member := bsonDocument(value)
+		host, _ := member["host"].(string)
+		podName := hosts(host)
+		if podName == "" {
+			continue
+		}
+		hidden, _ := member["hidden"].(bool)
+		arbiterOnly, _ := member["arbiterOnly"].(bool)
+		switch {
+		case arbiterOnly:
+			roles[podName] = roleArbiter
+		case hidden:
+			roles[podName] = roleHidden
+		default:
+			roles[podName] = roleSecondary
+		}
+	}
+	return roles
+}
+
+// helloStrings returns the string elements of an array field in a "hello"
+// response, skipping anything that is not a string.
+func helloStrings(hello bson.M, field string) []string {
+	var values []any
+	switch v := hello[field].(type) {
+	case bson.A:
+		values = v
+	case []any:
+		values = v
+	}
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// podNameFromHost returns the first dot-separated label of a "host:port" member
+// address, or "" when the address is malformed. It is the dns-prefix
+// hostMapper.
+func podNameFromHost(hostPort string) string {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return ""
+	}
+	podName, _, _ := strings.Cut(host, ".")
+	return podName
+}
+
+// run starts l's event recorder, pod informer and leader election, then
+// reconciles until ctx is cancelled. A start-up failure is logged rather than
+// fatal, so with REPLICA_SETS_FILE one broken replica set does not stop the
+// others: without the informer l lists pods from the apiserver, and without a
+// leader elector it stays on standby.
+func (l *Labeler) run(ctx context.Context) {
+	logError := func(err error, msg string) {
+		withReplicaSet(phuslog.Error(), l.Config.Name).Err(err).Msg(msg)
+	}
+
+	if err := l.startEventRecorder(ctx); err != nil {
+		logError(err, "failed to start event recorder")
+	}
+	if err := l.startPodInformer(ctx); err != nil {
+		logError(err, "failed to start pod informer")
+	}
+
+	if l.Config.LeaderElectionLeaseName != "" {
+		if err := l.startLeaderElection(ctx); err != nil {
+			logError(err, "failed to start leader election")
+		}
+	}
+
+	// With WATCH_TOPOLOGY the SDAM monitor triggers reconciles as soon as the
+	// primary changes, and the interval is only a slow safety-net resync, so
+	// failures are retried sooner than it.
+	interval := l.Config.ReconcileInterval
+	retryBase := interval
+	if l.Config.WatchTopology {
+		retryBase = min(interval, defaultReconcileInterval)
+	}
+
+	// A failed reconcile is retried with a growing, jittered delay instead of
+	// the interval, and a failure that keeps repeating is only logged once per
+	// errorLogInterval.
+	backoff := newReconcileBackoff(retryBase)
+	errorLog := &errorLogLimiter{interval: errorLogInterval}
+	reconcile := func() time.Duration {
+		failures := l.consecutiveFailures.Load()
+		err := l.reconcile()
+		if err == nil {
+			if failures > 0 {
+				withReplicaSet(phuslog.Info(), l.Config.Name).
+					Int64("failures", failures).
+					Int("suppressed_errors", errorLog.reset()).
+					Msg("reconcile succeeded again")
+			}
+			backoff = newReconcileBackoff(retryBase)
+			return interval
+		}
+		delay := backoff.Step()
+		if suppressed, ok := errorLog.allow(err, time.Now()); ok {
+			withReplicaSet(phuslog.Error(), l.Config.Name).
+				Err(err).
+				Int("suppressed_errors", suppressed).
+				Dur("retry_in", delay).
+				Msg("failed to set primary label")
+		} else {
+			withReplicaSet(phuslog.Debug(), l.Config.Name).Err(err).Dur("retry_in", delay).Msg("failed to set primary label")
+		}
+		return delay
+	}
+
+	// Reconcile once immediately so pod labels converge at startup instead of
+	// only after the first interval.
+	timer := time.NewTimer(reconcile())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			withReplicaSet(phuslog.Info(), l.Config.Name).Msg("shutdown signal received, stopping")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			l.closeMongo(shutdownCtx)
+			cancel()
+			return
+		case <-timer.C:
+			timer.Reset(reconcile())
+		case <-l.topologyChanged:
+			timer.Reset(reconcile())
+		case <-l.podsChanged:
+			timer.Reset(reconcile())
+		case <-l.leaderElected:
+			timer.Reset(reconcile())
+		}
+	}
 }
 
 func main() {
 	phuslog.DefaultLogger = configureLogger(phuslog.InfoLevel)
 
-	config, err := getConfigFromEnvironment()
+	cmd, err := parseCommandLine(os.Args[1:], "")
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(os.Stderr)
+		return
+	}
+	if err != nil {
+		phuslog.Fatal().Err(err).Msg("failed to read configuration")
+	}
+	config, err := loadConfig(cmd)
 	if err != nil {
 		phuslog.Fatal().Err(err).Msg("failed to read configuration")
 	}
+	if cmd.printConfig {
+		if err := writeEffectiveConfig(os.Stdout, config); err != nil {
+			phuslog.Fatal().Err(err).Msg("failed to print configuration")
+		}
+		return
+	}
 	phuslog.DefaultLogger = configureLogger(config.LogLevel)
 	phuslog.Info().
 		Str("namespace", config.Namespace).
 		Str("label_selector", config.LabelSelector).
 		Str("mongo_address", config.Address).
+		Str("mongo_username", config.MongoAuth.Username).
+		Stringer("mongo_password", config.MongoAuth.Password).
+		Str("mongo_auth_source", config.MongoAuth.Source).
+		Str("mongo_auth_mechanism", config.MongoAuth.Mechanism).
+		Bool("mongo_tls", config.MongoTLS.Enabled).
+		Str("mongo_tls_ca_file", config.MongoTLS.CAFile).
+		Str("mongo_tls_cert_file", config.MongoTLS.CertFile).
+		Bool("mongo_tls_insecure_skip_verify", config.MongoTLS.InsecureSkipVerify).
+		Stringer("primary_label", config.PrimaryLabel).
+		Str("non_primary_label_value", config.PrimaryLabel.NonPrimaryValue).
+		Stringer("host_mapping", config.HostMapping).
+		Str("no_primary_policy", config.NoPrimaryPolicy).
+		Dur("no_primary_grace_period", config.NoPrimaryGracePeriod).
 		Bool("label_all", config.LabelAll).
+		Bool("label_roles", config.LabelRoles).
+		Bool("sharded", config.Sharded).
+		Bool("quorum_check", config.QuorumCheck).
+		Bool("election_fencing", config.ElectionFencing).
+		Bool("annotate_pods", config.AnnotatePods).
+		Dur("replication_lag_threshold", config.ReplicationLagThreshold).
+		Bool("watch_topology", config.WatchTopology).
+		Bool("dry_run", config.DryRun).
+		Bool("server_side_apply", config.ServerSideApply).
+		Str("field_manager", config.FieldManager).
+		Bool("force_conflicts", config.ForceConflicts).
+		Str("leader_election_lease_name", config.LeaderElectionLeaseName).
+		Str("listen_address", config.ListenAddress).
+		Int("readiness_failure_threshold", config.ReadinessFailureThreshold).
+		Dur("readiness_max_staleness", config.ReadinessMaxStaleness).
 		Str("log_level", config.LogLevel.String()).
 		Dur("k8s_request_timeout", config.K8sRequestTimeout).
+		Dur("reconcile_interval", config.ReconcileInterval).
+		Dur("mongo_command_timeout", config.MongoCommandTimeout).
 		Msg("starting with configuration")
+	if config.MongoTLS.InsecureSkipVerify {
+		phuslog.Warn().Msg("MONGO_TLS_INSECURE_SKIP_VERIFY is set, the mongo server certificate is not verified")
+	}
 
-	labeler, err := New(config)
-	if err != nil {
-		phuslog.Fatal().Err(err).Msg("failed to initialize labeler")
+	for _, rs := range config.ReplicaSets {
+		phuslog.Info().
+			Str("replica_set", rs.Name).
+			Str("namespace", rs.Namespace).
+			Str("label_selector", rs.LabelSelector).
+			Str("mongo_address", rs.address()).
+			Msg("labelling replica set from REPLICA_SETS_FILE")
+	}
+
+	var labelers []*Labeler
+	for _, c := range config.replicaSetConfigs() {
+		labeler, err := New(c)
+		if err != nil {
+			phuslog.Fatal().Err(err).Str("replica_set", c.Name).Msg("failed to initialize labeler")
+		}
+		labelers = append(labelers, labeler)
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	reconcile := func() {
-		if err := labeler.setPrimaryLabel(); err != nil {
-			phuslog.Error().Err(err).Msg("failed to set primary label")
+	if config.ListenAddress != "" {
+		for _, labeler := range labelers {
+			if err := registerLastSuccessMetric(metricsRegistry, labeler); err != nil {
+				phuslog.Fatal().Err(err).Msg("failed to register metrics")
+			}
 		}
+		go serveHTTP(ctx, config.ListenAddress, newHTTPHandler(labelers...))
 	}
 
-	// Reconcile once immediately so pod labels converge at startup instead of
-	// only after the first tick fires.
-	reconcile()
-
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			phuslog.Info().Msg("shutdown signal received, stopping")
-			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			labeler.closeMongo(shutdownCtx)
-			cancel()
-			return
-		case <-ticker.C:
-			reconcile()
-		}
+	// Every replica set runs its own loop, so a slow or failing one never
+	// delays the others.
+	var wg sync.WaitGroup
+	for _, labeler := range labelers {
+		wg.Go(func() { labeler.run(ctx) })
 	}
+	wg.Wait()
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "mongo_labeler"
+
+// metricsRegistry is served on /metrics. A dedicated registry keeps the output
+// limited to the labeler's own metrics plus the standard Go and process ones.
+var metricsRegistry = newMetricsRegistry()
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// Every labeler metric carries a replica_set label naming the entry of
+// REPLICA_SETS_FILE it belongs to; it is empty for a single replica set.
+var (
+	reconcilesTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconciles_total",
+		Help:      "Reconciles run, by result (success or error).",
+	}, []string{"replica_set", "result"})
+
+	reconcileDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Time taken by a reconcile, including the Mongo and Kubernetes calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"replica_set"})
+
+	patchesTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patches_total",
+		Help:      "Pod label patches, by outcome.",
+	}, []string{"replica_set", "outcome"})
+
+	kubernetesErrorsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "kubernetes_errors_total",
+		Help:      "Failed Kubernetes API operations, by operation.",
+	}, []string{"replica_set", "operation"})
+
+	mongoErrorsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mongo_errors_total",
+		Help:      "Failed attempts to resolve the replica set topology from MongoDB.",
+	}, []string{"replica_set"})
+
+	failoversTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "failovers_total",
+		Help:      "Observed changes of the primary pod after the first detection.",
+	}, []string{"replica_set"})
+
+	noPrimaryTransitionsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "no_primary_transitions_total",
+		Help:      "Replica sets losing their primary (lost), having NO_PRIMARY_POLICY applied (stripped or marked_unknown) and getting one again (recovered).",
+	}, []string{"replica_set", "transition"})
+
+	primaryInfo = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "primary_info",
+		Help:      "Always 1, labelled with the pod currently labelled as primary of each shard (empty outside sharded mode).",
+	}, []string{"replica_set", "shard", "pod"})
+)
+
+// Values of the patches_total "outcome" label.
+const (
+	patchOutcomeSuccess = "success"
+	patchOutcomeError   = "error"
+	// patchOutcomeConflict counts the patches refused because the pod changed
+	// since it was read; patchOutcomeDryRun those DRY_RUN held back.
+	patchOutcomeConflict = "conflict"
+	patchOutcomeDryRun   = "dry_run"
+)
+
+// registerLastSuccessMetric exposes the seconds since l last reconciled
+// successfully, computed at scrape time so it keeps growing while the labeler
+// is stuck.
+func registerLastSuccessMetric(registry prometheus.Registerer, l *Labeler) error {
+	return registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "seconds_since_last_success",
+		Help:        "Seconds since the last successful reconcile, or since startup if none has succeeded yet.",
+		ConstLabels: prometheus.Labels{"replica_set": l.Config.Name},
+	}, func() float64 {
+		return time.Since(l.lastSuccessTime()).Seconds()
+	}))
+}
+
+// setPrimaryInfo points primary_info for shard of replicaSet at podName,
+// dropping the previous pod.
+func setPrimaryInfo(replicaSet, shard, podName string) {
+	primaryInfo.DeletePartialMatch(prometheus.Labels{"replica_set": replicaSet, "shard": shard})
+	primaryInfo.WithLabelValues(replicaSet, shard, podName).Set(1)
+}
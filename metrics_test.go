@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestReconcile_RecordsMetrics(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1", "mongo-2")
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+
+	successes := testutil.ToFloat64(reconcilesTotal.WithLabelValues("", "success"))
+	patches := testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeSuccess))
+	failovers := testutil.ToFloat64(failoversTotal.WithLabelValues(""))
+
+	require.NoError(t, labeler.reconcile())
+	assert.InDelta(t, successes+1, testutil.ToFloat64(reconcilesTotal.WithLabelValues("", "success")), 0)
+	assert.InDelta(t, patches+3, testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeSuccess)), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(primaryInfo.WithLabelValues("", "", "mongo-1")), 0)
+	assert.WithinDuration(t, time.Now(), labeler.lastSuccessTime(), time.Second)
+
+	// The first detection is not a failover; the move to mongo-2 is.
+	assert.InDelta(t, failovers, testutil.ToFloat64(failoversTotal.WithLabelValues("")), 0)
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-2"}, nil
+	}
+	require.NoError(t, labeler.reconcile())
+	assert.InDelta(t, failovers+1, testutil.ToFloat64(failoversTotal.WithLabelValues("")), 0)
+	assert.Equal(t, 1, testutil.CollectAndCount(primaryInfo), "only the current primary is reported")
+	assert.InDelta(t, 1, testutil.ToFloat64(primaryInfo.WithLabelValues("", "", "mongo-2")), 0)
+}
+
+func TestReconcile_RecordsErrors(t *testing.T) {
+	k8sClient := newMongoClientset("default", "mongo-0", "mongo-1")
+	labeler := newTestLabeler(k8sClient, true, "mongo-1")
+	labeler.topologyResolver = func() (*topology, error) {
+		return nil, errors.New("mongo unavailable")
+	}
+
+	errorsBefore := testutil.ToFloat64(reconcilesTotal.WithLabelValues("", "error"))
+	mongoErrors := testutil.ToFloat64(mongoErrorsTotal.WithLabelValues(""))
+	require.Error(t, labeler.reconcile())
+	assert.InDelta(t, errorsBefore+1, testutil.ToFloat64(reconcilesTotal.WithLabelValues("", "error")), 0)
+	assert.InDelta(t, mongoErrors+1, testutil.ToFloat64(mongoErrorsTotal.WithLabelValues("")), 0)
+	assert.True(t, labeler.lastSuccessTime().IsZero(), "no successful reconcile yet")
+
+	labeler.topologyResolver = func() (*topology, error) {
+		return &topology{Primary: "mongo-1"}, nil
+	}
+	k8sClient.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	patchErrors := testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeError))
+	k8sPatchErrors := testutil.ToFloat64(kubernetesErrorsTotal.WithLabelValues("", "patch"))
+	require.Error(t, labeler.reconcile())
+	assert.InDelta(t, patchErrors+1, testutil.ToFloat64(patchesTotal.WithLabelValues("", patchOutcomeError)), 0)
+	assert.InDelta(t, k8sPatchErrors+1, testutil.ToFloat64(kubernetesErrorsTotal.WithLabelValues("", "patch")), 0)
+}
+
+func TestSecondsSinceLastSuccessMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	labeler := &Labeler{Config: &Config{}, startedAt: time.Now().Add(-time.Minute)}
+	require.NoError(t, registerLastSuccessMetric(registry, labeler))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	assert.InDelta(t, 60, families[0].GetMetric()[0].GetGauge().GetValue(), 5)
+
+	labeler.lastSuccess.Store(time.Now().UnixNano())
+	families, err = registry.Gather()
+	require.NoError(t, err)
+	assert.Less(t, families[0].GetMetric()[0].GetGauge().GetValue(), 5.0)
+}
+
+func TestHTTPHandler_ServesMetrics(t *testing.T) {
+	server := httptest.NewServer(newHTTPHandler(&Labeler{Config: &Config{}}))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "mongo_labeler_reconcile_duration_seconds")
+	assert.Contains(t, string(body), "go_goroutines")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	phuslog "github.com/phuslu/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// NO_PRIMARY_POLICY values: what happens to the primary label of a replica set
+// that has no primary, during an election or after losing its majority.
+const (
+	// noPrimaryKeep leaves the labels as they are.
+	noPrimaryKeep = "keep"
+	// noPrimaryStrip gives every pod the non-primary state: the
+	// NON_PRIMARY_LABEL_VALUE with LABEL_ALL, no label otherwise.
+	noPrimaryStrip = "strip"
+	// noPrimaryUnknown sets the primary label of every pod to
+	// noPrimaryLabelValue.
+	noPrimaryUnknown = "unknown"
+)
+
+// noPrimaryLabelValue is the primary label value of every pod under
+// NO_PRIMARY_POLICY=unknown.
+const noPrimaryLabelValue = "unknown"
+
+// defaultNoPrimaryGracePeriod covers a normal election, which completes
+// within about 12 seconds.
+const defaultNoPrimaryGracePeriod = 30 * time.Second
+
+// errNoPrimary is returned when MongoDB reports no primary.
+var errNoPrimary = errors.New("replica set has no primary")
+
+// getNoPrimaryPolicyFromEnvironment reads NO_PRIMARY_POLICY and
+// NO_PRIMARY_GRACE_PERIOD.
+func getNoPrimaryPolicyFromEnvironment(primaryLabel PrimaryLabel) (string, time.Duration, error) {
+	policy := envString("NO_PRIMARY_POLICY", noPrimaryKeep)
+	switch policy {
+	case noPrimaryKeep, noPrimaryStrip:
+	case noPrimaryUnknown:
+		if primaryLabel.Value == noPrimaryLabelValue || primaryLabel.NonPrimaryValue == noPrimaryLabelValue {
+			return "", 0, fmt.Errorf("NO_PRIMARY_POLICY=%s needs primary label values other than %q", noPrimaryUnknown, noPrimaryLabelValue)
+		}
+	default:
+		return "", 0, fmt.Errorf("invalid NO_PRIMARY_POLICY value %q: must be one of %s, %s or %s", policy, noPrimaryKeep, noPrimaryStrip, noPrimaryUnknown)
+	}
+
+	gracePeriod, err := envDuration("NO_PRIMARY_GRACE_PERIOD", defaultNoPrimaryGracePeriod)
+	if err != nil {
+		return "", 0, err
+	}
+	if gracePeriod < 0 {
+		return "", 0, fmt.Errorf("invalid NO_PRIMARY_GRACE_PERIOD value %s: must not be negative", gracePeriod)
+	}
+	return policy, gracePeriod, nil
+}
+
+// applyNoPrimaryPolicy handles a replica set without a primary: the first time
+// it is seen the loss is logged and counted, and once it has lasted
+// NO_PRIMARY_GRACE_PERIOD the primary label of pods is stripped or set to
+// unknown as NO_PRIMARY_POLICY says. Other labels are left as they are.
+func (l *Labeler) applyNoPrimaryPolicy(top *topology, pods []*corev1.Pod) error {
+	now := time.Now()
+	since, ok := l.noPrimarySince[top.Shard]
+	if !ok {
+		since = now
+		if l.noPrimarySince == nil {
+			l.noPrimarySince = map[string]time.Time{}
+		}
+		l.noPrimarySince[top.Shard] = since
+		withShard(withReplicaSet(phuslog.Warn(), l.Config.Name), top.Shard).
+			Str("last_primary", l.lastPrimary[top.Shard]).
+			Str("policy", l.Config.NoPrimaryPolicy).
+			Msg("replica set has no primary")
+		noPrimaryTransitionsTotal.WithLabelValues(l.Config.Name, "lost").Inc()
+	}
+
+	var want any
+	transition := "stripped"
+	switch l.Config.NoPrimaryPolicy {
+	case noPrimaryStrip:
+		if l.Config.LabelAll {
+			want = l.Config.PrimaryLabel.NonPrimaryValue
+		}
+	case noPrimaryUnknown:
+		want = noPrimaryLabelValue
+		transition = "marked_unknown"
+	default:
+		return nil
+	}
+	if now.Sub(since) < l.Config.NoPrimaryGracePeriod {
+		return nil
+	}
+
+	var patched []string
+	for _, pod := range pods {
+		pod, changes, err := l.updatePod(pod, func(pod *corev1.Pod) (map[string]any, map[string]any) {
+			return labelChanges(pod.Labels, map[string]any{l.Config.PrimaryLabel.Key: want}), nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		l.recordPrimaryTransition(pod, changes, "")
+		patched = append(patched, pod.GetName())
+	}
+	if len(patched) > 0 {
+		withShard(withReplicaSet(phuslog.Warn(), l.Config.Name), top.Shard).
+			Strs("pods", patched).
+			Dur("without_primary", now.Sub(since)).
+			Msgf("no primary, applied NO_PRIMARY_POLICY=%s", l.Config.NoPrimaryPolicy)
+		noPrimaryTransitionsTotal.WithLabelValues(l.Config.Name, transition).Inc()
+	}
+	return nil
+}
+
+// primaryRecovered ends the no-primary state of top's replica set, if any.
+func (l *Labeler) primaryRecovered(top *topology) {
+	since, ok := l.noPrimarySince[top.Shard]
+	if !ok {
+		return
+	}
+	delete(l.noPrimarySince, top.Shard)
+	withShard(withReplicaSet(phuslog.Info(), l.Config.Name), top.Shard).
+		Str("pod", top.Primary).
+		Dur("without_primary", time.Since(since)).
+		Msg("replica set has a primary again")
+	noPrimaryTransitionsTotal.WithLabelValues(l.Config.Name, "recovered").Inc()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestGetNoPrimaryPolicyFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		primaryLabel    PrimaryLabel
+		wantPolicy      string
+		wantGracePeriod time.Duration
+		wantErr         string
+	}{
+		{name: "default", env: map[string]string{}, wantPolicy: noPrimaryKeep, wantGracePeriod: defaultNoPrimaryGracePeriod},
+		{
+			name:            "strip with grace period",
+			env:             map[string]string{"NO_PRIMARY_POLICY": "strip", "NO_PRIMARY_GRACE_PERIOD": "1m"},
+			wantPolicy:      noPrimaryStrip,
+			wantGracePeriod: time.Minute,
+		},
+		{
+			name:            "unknown without grace period",
+			env:             map[string]string{"NO_PRIMARY_POLICY": "unknown", "NO_PRIMARY_GRACE_PERIOD": "0s"},
+			wantPolicy:      noPrimaryUnknown,
+			wantGracePeriod: 0,
+		},
+		{name: "invalid policy", env: map[string]string{"NO_PRIMARY_POLICY": "drop"}, wantErr: `invalid NO_PRIMARY_POLICY value "drop"`},
+		{
+			name:         "unknown clashing with the non-primary value",
+			env:          map[string]string{"NO_PRIMARY_POLICY": "unknown"},
+			primaryLabel: PrimaryLabel{Key: "role", Value: "primary", NonPrimaryValue: "unknown"},
+			wantErr:      `needs primary label values other than "unknown"`,
+		},
+		{name: "invalid grace period", env: map[string]string{"NO_PRIMARY_GRACE_PERIOD": "soon"}, wantErr: "invalid NO_PRIMARY_GRACE_PERIOD value"},
+		{name: "negative grace period", env: map[string]string{"NO_PRIMARY_GRACE_PERIOD": "-1s"}, wantErr: "must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfigEnv(t, tt.env)
+			primaryLabel := tt.primaryLabel
+			if primaryLabel.Key == "" {
+				primaryLabel = defaultPrimaryLabel
+			}
+			policy, gracePeriod, err := getNoPrimaryPolicyFromEnvironment(primaryLabel)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPolicy, policy)
+			assert.Equal(t, tt.wantGracePeriod, gracePeriod)
+		})
+	}
+}
+
+func TestParsePrimaryPodName_NoPrimary(t *testing.T) {
+	_, err := parsePrimaryPodName(bson.M{"setName": "rs0", "isWritablePrimary": false}, podNameFromHost)
+	require.ErrorIs(t, err, errNoPrimary)
+
+	_, err = parsePrimaryPodName(bson.M{"primary": "mongo-0.mongo.default.svc.cluster.local"}, podNameFromHost)
+	require.NotErrorIs(t, err, errNoPrimary, "a malformed primary is not a missing one")
+}
+
+func TestSetPrimaryLabel_NoPrimaryPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		labelAll    bool
+		gracePeriod time.Duration
+		want        map[string]string
+	}{
+		{name: "keep", policy: noPrimaryKeep, labelAll: true, want: map[string]string{"mongo-0": "true", "mongo-1": "false"}},
+		{name: "strip", policy: noPrimaryStrip, want: map[string]string{"mongo-0": "", "mongo-1": ""}},
+		{name: "strip with LABEL_ALL", policy: noPrimaryStrip, labelAll: true, want: map[string]string{"mongo-0": "false", "mongo-1": "false"}},
+		{name: "unknown", policy: noPrimaryUnknown, want: map[string]string{"mongo-0": "unknown", "mongo-1": "unknown"}},
+		{
+			name:        "within the grace period",
+			policy:      noPrimaryStrip,
+			labelAll:    true,
+			gracePeriod: time.Hour,
+			want:        map[string]string{"mongo-0": "true", "mongo-1": "false"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := map[string]string{"mongo-0": "true", "mongo-1": ""}
+			if tt.labelAll {
+				primary["mongo-1"] = "false"
+			}
+			k8sClient := newClientsetWithPrimary("default", primary)
+			labeler := newTestLabeler(k8sClient, tt.labelAll, "")
+			labeler.Config.NoPrimaryPolicy = tt.policy
+			labeler.Config.NoPrimaryGracePeriod = tt.gracePeriod
+			labeler.topologyResolver = func() (*topology, error) {
+				return nil, fmt.Errorf("invalid primary host %q: %w", "", errNoPrimary)
+			}
+
+			err := labeler.setPrimaryLabel()
+			require.ErrorIs(t, err, errNoPrimary, "the reconcile still fails without a primary")
+			labels, _ := podMetadata(t, k8sClient)
+			for podName, want := range tt.want {
+				assert.Equal(t, want, labels[podName]["primary"], podName)
+			}
+		})
+	}
+}
+
+func TestSetPrimaryLabel_NoPrimaryTransitions(t *testing.T) {
+	k8sClient := newClientsetWithPrimary("default", map[string]string{"mongo-0": "true", "mongo-1": "false"})
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.Config.NoPrimaryPolicy = noPrimaryUnknown
+	report := func(primary string) {
+		labeler.topologyResolver = func() (*topology, error) {
+			if primary == "" {
+				return nil, errNoPrimary
+			}
+			return &topology{Primary: primary}, nil
+		}
+	}
+	count := func(transition string) float64 {
+		return testutil.ToFloat64(noPrimaryTransitionsTotal.WithLabelValues("", transition))
+	}
+	lost, marked, recovered := count("lost"), count("marked_unknown"), count("recovered")
+
+	report("")
+	require.ErrorIs(t, labeler.setPrimaryLabel(), errNoPrimary)
+	require.ErrorIs(t, labeler.setPrimaryLabel(), errNoPrimary)
+	assert.InDelta(t, lost+1, count("lost"), 0, "the loss is counted once")
+	assert.InDelta(t, marked+1, count("marked_unknown"), 0, "pods already unknown are not patched again")
+
+	report("mongo-1")
+	require.NoError(t, labeler.setPrimaryLabel())
+	assert.InDelta(t, recovered+1, count("recovered"), 0)
+	assert.Empty(t, labeler.noPrimarySince)
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, "false", labels["mongo-0"]["primary"])
+	assert.Equal(t, "true", labels["mongo-1"]["primary"])
+}
+
+func TestSetPrimaryLabel_NoPrimaryPolicyWithQuorumCheck(t *testing.T) {
+	hosts := bson.A{"mongo-0.mongo:27017", "mongo-1.mongo:27017"}
+	secondary := func(me string) bson.M {
+		return bson.M{"setName": "rs0", "me": me, "hosts": hosts, "setVersion": int32(1), "isWritablePrimary": false}
+	}
+	k8sClient := newClientsetWithPrimary("default", map[string]string{"mongo-0": "true", "mongo-1": ""})
+	labeler := newTestLabeler(k8sClient, false, "")
+	labeler.topologyResolver = nil
+	labeler.Config.QuorumCheck = true
+	labeler.Config.MongoCommandTimeout = time.Second
+	labeler.Config.NoPrimaryPolicy = noPrimaryStrip
+	labeler.helloFetcher = func(context.Context) (bson.M, error) {
+		return secondary("mongo-0.mongo:27017"), nil
+	}
+	labeler.configFetcher = func(context.Context) (bson.M, error) {
+		return replSetConfig(map[string]int32{"mongo-0.mongo:27017": 1, "mongo-1.mongo:27017": 1}), nil
+	}
+	labeler.memberHelloFetcher = func(_ context.Context, host string) (bson.M, error) {
+		if host == "mongo-1.mongo:27017" {
+			return nil, errors.New("unreachable")
+		}
+		return secondary(host), nil
+	}
+
+	err := labeler.setPrimaryLabel()
+	require.ErrorIs(t, err, errNoQuorum)
+	require.ErrorIs(t, err, errNoPrimary, "no member reporting a primary is a missing primary")
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Empty(t, labels["mongo-0"]["primary"], "the old primary loses its label")
+}
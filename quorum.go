@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	phuslog "github.com/phuslu/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// errNoQuorum is returned with QUORUM_CHECK when no primary is confirmed by a
+// majority of the replica set members. When no member reports a primary at
+// all it also wraps errNoPrimary, so NO_PRIMARY_POLICY applies.
+var errNoQuorum = errors.New("primary not confirmed by a majority of members")
+
+// confirmPrimary cross-checks the primary reported in seed, the hello response
+// of the node behind MONGO_URI or of a shard, with every voting member of the
+// replica set, read from the replSetGetConfig response of fetchConfig. It
+// returns the hello response to build the topology from: the one of the
+// primary a majority of votes agrees on. A partitioned old primary that still
+// reports itself as primary is outvoted, so its pod is never promoted.
+func (l *Labeler) confirmPrimary(ctx context.Context, seed bson.M, fetchConfig func(ctx context.Context) (bson.M, error)) (bson.M, error) {
+	members := l.votingMembers(ctx, seed, fetchConfig)
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%w: no voting members", errNoQuorum)
+	}
+	fetch := l.memberHelloFetcher
+	if fetch == nil {
+		fetch = l.fetchMemberHello
+	}
+
+	answers := make([]bson.M, len(members))
+	var wg sync.WaitGroup
+	for i, host := range members {
+		wg.Go(func() {
+			hello, err := fetch(ctx, host)
+			if err != nil {
+				withReplicaSet(phuslog.Debug(), l.Config.Name).Str("host", host).Err(err).Msg("member did not answer the quorum check")
+				return
+			}
+			answers[i] = hello
+		})
+	}
+	wg.Wait()
+	return electPrimary(len(members), answers)
+}
+
+// votingMembers returns the hosts of the members with a vote. hello leaves out
+// hidden members and lists passive ones without their votes, so it is only
+// used when replSetGetConfig fails: every member it lists is then counted,
+// which can only raise the majority needed.
+func (l *Labeler) votingMembers(ctx context.Context, seed bson.M, fetchConfig func(ctx context.Context) (bson.M, error)) []string {
+	response, err := fetchConfig(ctx)
+	if err == nil {
+		if members := parseVotingMembers(response); len(members) > 0 {
+			return members
+		}
+		err = errors.New("replSetGetConfig lists no voting members")
+	}
+	withReplicaSet(phuslog.Warn(), l.Config.Name).Err(err).Msg("unable to read the voting members, counting every member hello lists")
+	return slices.Concat(helloStrings(seed, "hosts"), helloStrings(seed, "passives"), helloStrings(seed, "arbiters"))
+}
+
+// parseVotingMembers returns the hosts in a replSetGetConfig response whose
+// votes are not 0; a member without votes has the default of 1.
+func parseVotingMembers(response bson.M) []string {
+	config := bsonDocument(response["config"])
+	members, _ := config["members"].(bson.A)
+	var hosts []string
+	for _, value := range members {
+		member := bsonDocument(value)
+		host, _ := member["host"].(string)
+		if votes, ok := bsonInt64(member["votes"]); host == "" || (ok && votes == 0) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// fetchReplSetConfig returns the decoded "replSetGetConfig" command response.
+func (l *Labeler) fetchReplSetConfig(ctx context.Context) (bson.M, error) {
+	client, err := l.connectMongo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := runAdminCommand(ctx, client, "replSetGetConfig")
+	if err != nil {
+		return nil, fmt.Errorf("run replSetGetConfig command on mongo at %q: %w", l.Config.Address, err)
+	}
+	return config, nil
+}
+
+// electPrimary picks the primary from the hello answers of the members, nil
+// for those that did not answer:
+//
+//   - answers with a setVersion below the highest one come from members that
+//     have not seen the current replica set config and are discarded;
+//   - of the members claiming to be primary, only the one with the highest
+//     (electionId, setVersion) is believed, as in the driver's SDAM rules;
+//   - every remaining answer votes for the primary it reports, and the
+//     primary needs the votes of a majority of voting members.
+//
+// It returns the winner's own answer, or if it did not answer, one of the
+// answers that voted for it.
+func electPrimary(members int, answers []bson.M) (bson.M, error) {
+	var maxSetVersion int64
+	var newest bson.M
+	for _, hello := range answers {
+		if hello == nil {
+			continue
+		}
+		setVersion, _ := bsonInt64(hello["setVersion"])
+		maxSetVersion = max(maxSetVersion, setVersion)
+		if helloIsWritablePrimary(hello) && (newest == nil || compareElection(hello, newest) > 0) {
+			newest = hello
+		}
+	}
+
+	votes := map[string][]bson.M{}
+	for _, hello := range answers {
+		if hello == nil {
+			continue
+		}
+		if setVersion, _ := bsonInt64(hello["setVersion"]); setVersion < maxSetVersion {
+			continue
+		}
+		if helloIsWritablePrimary(hello) && compareElection(hello, newest) < 0 {
+			continue
+		}
+		if primary := helloPrimaryHost(hello); primary != "" {
+			votes[primary] = append(votes[primary], hello)
+		}
+	}
+
+	majority := members/2 + 1
+	var best string
+	for primary, voters := range votes {
+		if len(voters) > len(votes[best]) || (len(voters) == len(votes[best]) && primary < best) {
+			best = primary
+		}
+	}
+	if len(votes[best]) < majority {
+		if best == "" {
+			return nil, fmt.Errorf("%w: no member reports a primary, %d of %d answered: %w", errNoQuorum, countAnswers(answers), members, errNoPrimary)
+		}
+		return nil, fmt.Errorf("%w: %q has %d of %d votes, %d needed", errNoQuorum, best, len(votes[best]), members, majority)
+	}
+
+	voters := votes[best]
+	if i := slices.IndexFunc(voters, helloIsWritablePrimary); i >= 0 {
+		return voters[i], nil
+	}
+	return voters[0], nil
+}
+
+// compareElection orders two primaries' hello answers by (electionId,
+// setVersion).
+func compareElection(a, b bson.M) int {
+	aID, _ := a["electionId"].(bson.ObjectID)
+	bID, _ := b["electionId"].(bson.ObjectID)
+	if c := bytes.Compare(aID[:], bID[:]); c != 0 {
+		return c
+	}
+	aVersion, _ := bsonInt64(a["setVersion"])
+	bVersion, _ := bsonInt64(b["setVersion"])
+	return cmp.Compare(aVersion, bVersion)
+}
+
+// countAnswers returns how many members answered.
+func countAnswers(answers []bson.M) int {
+	n := 0
+	for _, hello := range answers {
+		if hello != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// fetchMemberHello runs hello on one member through a direct connection.
+func (l *Labeler) fetchMemberHello(ctx context.Context, host string) (bson.M, error) {
+	client, err := l.memberClient(host)
+	if err != nil {
+		return nil, err
+	}
+	hello, err := runAdminCommand(ctx, client, "hello")
+	if err != nil {
+		return nil, fmt.Errorf("run hello command on %q: %w", host, err)
+	}
+	return hello, nil
+}
+
+// memberClient returns the long-lived direct client of one member, connecting
+// it on first use with the credentials and TLS settings of MONGO_URI.
+func (l *Labeler) memberClient(host string) (*mongo.Client, error) {
+	client, err := l.memberClients.get(host, func() (*options.ClientOptions, error) {
+		clientOptions, err := l.hostClientOptions([]string{host})
+		if err != nil {
+			return nil, err
+		}
+		return clientOptions.SetDirect(true), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to member %q: %w", host, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// memberHello builds the hello answer of a member that reports primary.
+func memberHello(me, primary string, setVersion int64, electionID bson.ObjectID) bson.M {
+	hello := bson.M{"me": me, "primary": primary, "setVersion": int32(setVersion), "isWritablePrimary": me == primary}
+	if me == primary {
+		hello["electionId"] = electionID
+	}
+	return hello
+}
+
+// replSetConfig builds a replSetGetConfig response listing members, each with
+// its votes.
+func replSetConfig(votes map[string]int32) bson.M {
+	var members bson.A
+	for host, v := range votes {
+		members = append(members, bson.M{"host": host, "votes": v})
+	}
+	return bson.M{"config": bson.M{"members": members}}
+}
+
+func TestElectPrimary(t *testing.T) {
+	oldElection := bson.ObjectID{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1}
+	newElection := bson.ObjectID{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 2}
+	tests := []struct {
+		name        string
+		answers     []bson.M
+		wantPrimary string
+		wantErr     string
+	}{
+		{
+			name: "all members agree",
+			answers: []bson.M{
+				memberHello("mongo-0:27017", "mongo-0:27017", 3, newElection),
+				memberHello("mongo-1:27017", "mongo-0:27017", 3, newElection),
+				memberHello("mongo-2:27017", "mongo-0:27017", 3, newElection),
+			},
+			wantPrimary: "mongo-0:27017",
+		},
+		{
+			name: "partitioned old primary is outvoted",
+			answers: []bson.M{
+				memberHello("mongo-0:27017", "mongo-0:27017", 3, oldElection),
+				memberHello("mongo-1:27017", "mongo-1:27017", 3, newElection),
+				memberHello("mongo-2:27017", "mongo-1:27017", 3, newElection),
+			},
+			wantPrimary: "mongo-1:27017",
+		},
+		{
+			name: "majority without the primary's own answer",
+			answers: []bson.M{
+				nil,
+				memberHello("mongo-1:27017", "mongo-0:27017", 3, newElection),
+				memberHello("mongo-2:27017", "mongo-0:27017", 3, newElection),
+			},
+			wantPrimary: "mongo-0:27017",
+		},
+		{
+			name: "answers with an older config are discarded",
+			answers: []bson.M{
+				memberHello("mongo-0:27017", "mongo-0:27017", 2, oldElection),
+				memberHello("mongo-1:27017", "mongo-0:27017", 2, oldElection),
+				memberHello("mongo-2:27017", "mongo-2:27017", 3, newElection),
+			},
+			wantErr: `"mongo-2:27017" has 1 of 3 votes, 2 needed`,
+		},
+		{
+			name: "only the isolated old primary answers",
+			answers: []bson.M{
+				memberHello("mongo-0:27017", "mongo-0:27017", 3, oldElection),
+				nil,
+				nil,
+			},
+			wantErr: `"mongo-0:27017" has 1 of 3 votes, 2 needed`,
+		},
+		{
+			name: "no primary",
+			answers: []bson.M{
+				{"me": "mongo-0:27017", "setVersion": int32(3), "isWritablePrimary": false},
+				nil,
+			},
+			wantErr: "no member reports a primary, 1 of 2 answered",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := electPrimary(len(tt.answers), tt.answers)
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, errNoQuorum)
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPrimary, helloPrimaryHost(hello))
+		})
+	}
+}
+
+func TestGetMongoTopology_QuorumCheck(t *testing.T) {
+	oldElection := bson.ObjectID{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1}
+	newElection := bson.ObjectID{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 2}
+	hosts := bson.A{"mongo-0.mongo:27017", "mongo-1.mongo:27017", "mongo-2.mongo:27017"}
+	members := map[string]bson.M{
+		"mongo-0.mongo:27017": memberHello("mongo-0.mongo:27017", "mongo-0.mongo:27017", 3, oldElection),
+		"mongo-1.mongo:27017": memberHello("mongo-1.mongo:27017", "mongo-1.mongo:27017", 3, newElection),
+		"mongo-2.mongo:27017": memberHello("mongo-2.mongo:27017", "mongo-1.mongo:27017", 3, newElection),
+	}
+	for _, hello := range members {
+		hello["hosts"] = hosts
+	}
+
+	l := &Labeler{
+		Config: &Config{Address: "mongo-0.mongo:27017", QuorumCheck: true},
+		helloFetcher: func(context.Context) (bson.M, error) {
+			// The sidecar's own node is the partitioned old primary.
+			return members["mongo-0.mongo:27017"], nil
+		},
+		configFetcher: func(context.Context) (bson.M, error) {
+			return replSetConfig(map[string]int32{"mongo-0.mongo:27017": 1, "mongo-1.mongo:27017": 1, "mongo-2.mongo:27017": 1}), nil
+		},
+		memberHelloFetcher: func(_ context.Context, host string) (bson.M, error) {
+			if hello, ok := members[host]; ok {
+				return hello, nil
+			}
+			return nil, errors.New("unreachable")
+		},
+	}
+	top, err := l.getMongoTopology()
+	require.NoError(t, err)
+	assert.Equal(t, "mongo-1", top.Primary)
+
+	delete(members, "mongo-1.mongo:27017")
+	delete(members, "mongo-2.mongo:27017")
+	_, err = l.getMongoTopology()
+	require.ErrorIs(t, err, errNoQuorum)
+}
+
+func TestGetMongoTopology_QuorumCheckCountsVotingMembers(t *testing.T) {
+	election := bson.ObjectID{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1}
+	// mongo-0 is a partitioned old primary and mongo-1 has not noticed yet;
+	// the other side elected mongo-2 with the votes of the passive members.
+	members := map[string]bson.M{
+		"mongo-0.mongo:27017": memberHello("mongo-0.mongo:27017", "mongo-0.mongo:27017", 3, election),
+		"mongo-1.mongo:27017": memberHello("mongo-1.mongo:27017", "mongo-0.mongo:27017", 3, election),
+	}
+	seed := members["mongo-0.mongo:27017"]
+	seed["hosts"] = bson.A{"mongo-0.mongo:27017", "mongo-1.mongo:27017", "mongo-2.mongo:27017"}
+	seed["passives"] = bson.A{"mongo-3.mongo:27017", "mongo-4.mongo:27017"}
+	config := replSetConfig(map[string]int32{
+		"mongo-0.mongo:27017": 1, "mongo-1.mongo:27017": 1, "mongo-2.mongo:27017": 1,
+		"mongo-3.mongo:27017": 1, "mongo-4.mongo:27017": 1, "mongo-5.mongo:27017": 0,
+	})
+
+	tests := []struct {
+		name  string
+		fetch func(context.Context) (bson.M, error)
+	}{
+		{name: "from replSetGetConfig", fetch: func(context.Context) (bson.M, error) { return config, nil }},
+		{name: "from hello", fetch: func(context.Context) (bson.M, error) { return nil, errors.New("not authorized") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Labeler{
+				Config:        &Config{Address: "mongo-0.mongo:27017", QuorumCheck: true},
+				helloFetcher:  func(context.Context) (bson.M, error) { return seed, nil },
+				configFetcher: tt.fetch,
+				memberHelloFetcher: func(_ context.Context, host string) (bson.M, error) {
+					if hello, ok := members[host]; ok {
+						return hello, nil
+					}
+					return nil, errors.New("unreachable")
+				},
+			}
+			_, err := l.getMongoTopology()
+			require.ErrorIs(t, err, errNoQuorum)
+			require.ErrorContains(t, err, `"mongo-0.mongo:27017" has 2 of 5 votes, 3 needed`)
+		})
+	}
+}
+
+func TestParseVotingMembers(t *testing.T) {
+	response := bson.M{"config": bson.M{"members": bson.A{
+		bson.M{"host": "mongo-0:27017", "votes": int32(1)},
+		bson.M{"host": "mongo-1:27017"},
+		bson.M{"host": "hidden:27017", "votes": int32(1), "hidden": true},
+		bson.M{"host": "arbiter:27017", "votes": int32(1), "arbiterOnly": true},
+		bson.M{"host": "analytics:27017", "votes": int32(0), "priority": int32(0)},
+	}}}
+	assert.Equal(t, []string{"mongo-0:27017", "mongo-1:27017", "hidden:27017", "arbiter:27017"}, parseVotingMembers(response))
+	assert.Empty(t, parseVotingMembers(bson.M{}))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	phuslog "github.com/phuslu/log"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// ReplicaSetConfig is one entry of REPLICA_SETS_FILE. Namespace and
+// LabelSelector default to NAMESPACE and LABEL_SELECTOR; every other setting
+// is shared by all replica sets and read from the environment.
+type ReplicaSetConfig struct {
+	// Name identifies the replica set in logs, metrics and probes, and
+	// suffixes its leader election Lease name.
+	Name          string `json:"name"`
+	URI           secret `json:"uri,omitempty"`
+	Address       string `json:"address,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	LabelSelector string `json:"labelSelector,omitempty"`
+}
+
+// replicaSetsFile is the YAML or JSON document read from REPLICA_SETS_FILE:
+//
+//	replicaSets:
+//	  - name: users
+//	    uri: mongodb://users-0.users.db:27017/?replicaSet=users
+//	    namespace: db
+//	    labelSelector: app=users-mongo
+type replicaSetsFile struct {
+	ReplicaSets []ReplicaSetConfig `json:"replicaSets"`
+}
+
+// loadReplicaSetsFile reads and validates REPLICA_SETS_FILE. Unknown keys are
+// rejected so a misspelt field fails startup instead of being ignored.
+func loadReplicaSetsFile(path string) ([]ReplicaSetConfig, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		return nil, fmt.Errorf("read REPLICA_SETS_FILE: %w", err)
+	}
+	var file replicaSetsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("parse REPLICA_SETS_FILE %q: %w", path, err)
+	}
+	if len(file.ReplicaSets) == 0 {
+		return nil, fmt.Errorf("REPLICA_SETS_FILE %q lists no replica sets", path)
+	}
+
+	names := map[string]bool{}
+	for i, rs := range file.ReplicaSets {
+		if errs := validation.IsDNS1123Label(rs.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("replica set %d in REPLICA_SETS_FILE: invalid name %q: %v", i, rs.Name, errs)
+		}
+		if names[rs.Name] {
+			return nil, fmt.Errorf("replica set %q is listed twice in REPLICA_SETS_FILE", rs.Name)
+		}
+		names[rs.Name] = true
+		if err := rs.validateEndpoint(); err != nil {
+			return nil, fmt.Errorf("replica set %q in REPLICA_SETS_FILE: %w", rs.Name, err)
+		}
+	}
+	return file.ReplicaSets, nil
+}
+
+// validateEndpoint checks that exactly one of uri and address is set and that
+// it parses, like MONGO_URI and MONGO_ADDRESS.
+func (rs ReplicaSetConfig) validateEndpoint() error {
+	var uri string
+	switch {
+	case rs.URI != "" && rs.Address != "":
+		return fmt.Errorf("set only one of uri and address")
+	case rs.URI != "":
+		uri = string(rs.URI)
+	case rs.Address != "":
+		uri = "mongodb://" + rs.Address
+	default:
+		return fmt.Errorf("set one of uri and address")
+	}
+	if err := validateMongoURI(uri); err != nil {
+		return fmt.Errorf("invalid uri for %q: %w", rs.address(), err)
+	}
+	return nil
+}
+
+// address returns the host list of the replica set without credentials.
+func (rs ReplicaSetConfig) address() string {
+	if rs.URI != "" {
+		return mongoURIHosts(string(rs.URI))
+	}
+	return rs.Address
+}
+
+// replicaSetConfigs returns one Config per replica set to label: c itself
+// without REPLICA_SETS_FILE, otherwise a copy of c per entry with the entry's
+// endpoint, namespace and selector. Each copy gets its own Lease, so every
+// replica set elects its leader independently.
+func (c *Config) replicaSetConfigs() []*Config {
+	if len(c.ReplicaSets) == 0 {
+		return []*Config{c}
+	}
+	configs := make([]*Config, 0, len(c.ReplicaSets))
+	for _, rs := range c.ReplicaSets {
+		config := *c
+		config.ReplicaSets = nil
+		config.Name = rs.Name
+		config.URI = rs.URI
+		config.Address = rs.address()
+		if rs.Namespace != "" {
+			config.Namespace = rs.Namespace
+		}
+		if rs.LabelSelector != "" {
+			config.LabelSelector = rs.LabelSelector
+		}
+		if config.LeaderElectionLeaseName != "" {
+			config.LeaderElectionLeaseName += "-" + rs.Name
+		}
+		configs = append(configs, &config)
+	}
+	return configs
+}
+
+// withReplicaSet adds the REPLICA_SETS_FILE entry name, if any, to a log
+// entry.
+func withReplicaSet(entry *phuslog.Entry, name string) *phuslog.Entry {
+	if name == "" {
+		return entry
+	}
+	return entry.Str("replica_set", name)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	phuslog "github.com/phuslu/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	httpReadHeaderTimeout = 5 * time.Second
+	httpShutdownTimeout   = 5 * time.Second
+)
+
+// newHTTPHandler returns the mux served on LISTEN_ADDRESS: metrics plus the
+// liveness and readiness probes, which fail if they fail for any of labelers.
+func newHTTPHandler(labelers ...*Labeler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", probeHandler(checkAll(labelers, (*Labeler).checkLive)))
+	mux.Handle("/readyz", probeHandler(checkAll(labelers, (*Labeler).checkReady)))
+	return mux
+}
+
+// checkAll runs check for every labeler and joins the failures, each prefixed
+// with its replica set name in REPLICA_SETS_FILE mode.
+func checkAll(labelers []*Labeler, check func(*Labeler, time.Time) error) func(time.Time) error {
+	return func(now time.Time) error {
+		var errs []error
+		for _, l := range labelers {
+			err := check(l, now)
+			if err != nil && l.Config.Name != "" {
+				err = fmt.Errorf("replica set %q: %w", l.Config.Name, err)
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// serveHTTP serves handler on addr until ctx is cancelled, then shuts the
+// server down gracefully. Listen errors are logged rather than fatal so that a
+// port clash never stops the labeling itself.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			phuslog.Debug().Msgf("unable to shut down http server: %v", err)
+		}
+	}()
+
+	phuslog.Info().Str("address", addr).Msg("serving http endpoints")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		phuslog.Error().Err(err).Str("address", addr).Msg("http server failed")
+	}
+}
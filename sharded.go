@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	phuslog "github.com/phuslu/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// shardLabel is written to every selected pod in SHARDED mode, holding the
+// name of the shard the pod belongs to, or configShardName for config servers.
+// mongos pods and pods outside every replica set do not carry it.
+const (
+	shardLabel      = "mongo-shard"
+	configShardName = "config"
+)
+
+// mongosHelloMsg is the "msg" field of a hello response from mongos.
+const mongosHelloMsg = "isdbgrid"
+
+// mongosActiveWindow is how recently a mongos must have pinged the config
+// servers to be labelled. config.mongos keeps an entry for every mongos that
+// ever connected; a live one pings every 30 seconds.
+const mongosActiveWindow = 5 * time.Minute
+
+// cluster is the state of a sharded cluster: one topology per shard replica
+// set and for the config servers, plus the pod names of the active mongos
+// routers. Errors holds the shards that could not be resolved; their entry in
+// ReplicaSets has no primary, so their pods are left untouched unless
+// NO_PRIMARY_POLICY applies.
+type cluster struct {
+	ReplicaSets []*topology
+	Mongos      []string
+	Errors      []error
+}
+
+// shardHost is a shard as listed by listShards: its name and the replica set
+// connection string "setName/host:port,host:port".
+type shardHost struct {
+	Name string
+	Host string
+}
+
+// replicaSet splits the connection string into the replica set name and its
+// seed hosts.
+func (s shardHost) replicaSet() (string, []string, error) {
+	setName, hosts, ok := strings.Cut(s.Host, "/")
+	if !ok || setName == "" || hosts == "" {
+		return "", nil, fmt.Errorf("shard %q host %q is not a replica set", s.Name, s.Host)
+	}
+	return setName, strings.Split(hosts, ","), nil
+}
+
+// podNames returns the pods serving the shard's seed hosts.
+func (s shardHost) podNames(hosts hostMapper) []string {
+	_, seeds, _ := s.replicaSet()
+	var names []string
+	for _, host := range seeds {
+		if podName := hosts(host); podName != "" {
+			names = append(names, podName)
+		}
+	}
+	return names
+}
+
+// getClusterTopology resolves every replica set of the sharded cluster behind
+// MONGO_URI. The node type is taken from its hello response:
+//
+//   - mongos ("msg": "isdbgrid"): shards from listShards, config servers from
+//     getShardMap, routers from config.mongos.
+//   - config server ("configsvr" set): shards from config.shards, the config
+//     server replica set from hello, routers from config.mongos.
+//   - shard member: only its own replica set, named after setName.
+//
+// Each replica set is then queried through its own client, concurrently and
+// with its own timeout, so one unavailable shard does not hold up the others.
+func (l *Labeler) getClusterTopology() (*cluster, error) {
+	fetch := l.helloFetcher
+	if fetch == nil {
+		fetch = l.fetchHello
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.Config.MongoCommandTimeout)
+	defer cancel()
+
+	hello, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := l.hostMapper(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shards, mongos, err := l.discoverShards(ctx, hello, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	resolve := l.shardResolver
+	if resolve == nil {
+		resolve = l.fetchShardTopology
+	}
+	c := &cluster{ReplicaSets: make([]*topology, len(shards)), Mongos: mongos}
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Go(func() {
+			shardCtx, cancel := context.WithTimeout(context.Background(), l.Config.MongoCommandTimeout)
+			defer cancel()
+			top, err := resolve(shardCtx, shard, hosts)
+			if err != nil {
+				mongoErrorsTotal.WithLabelValues(l.Config.Name).Inc()
+				errs[i] = shardError(shard.Name, err)
+				top = &topology{Roles: map[string]string{}, NoPrimary: errors.Is(err, errNoPrimary)}
+				for _, podName := range shard.podNames(hosts) {
+					top.Roles[podName] = roleUnknown
+				}
+			}
+			top.Shard = shard.Name
+			c.ReplicaSets[i] = top
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			c.Errors = append(c.Errors, err)
+		}
+	}
+	return c, nil
+}
+
+// discoverShards lists the replica sets and mongos pods of the cluster, as
+// seen from the node that returned hello.
+func (l *Labeler) discoverShards(ctx context.Context, hello bson.M, hosts hostMapper) ([]shardHost, []string, error) {
+	run := l.commandRunner
+	if run == nil {
+		run = l.runCommand
+	}
+	setName, _ := hello["setName"].(string)
+	self := shardHost{Name: setName, Host: setName + "/" + strings.Join(helloStrings(hello, "hosts"), ",")}
+
+	var shards []shardHost
+	switch msg, _ := hello["msg"].(string); {
+	case msg == mongosHelloMsg:
+		response, err := run(ctx, "admin", bson.D{{Key: "listShards", Value: 1}})
+		if err != nil {
+			return nil, nil, fmt.Errorf("run listShards on mongos at %q: %w", l.Config.Address, err)
+		}
+		shards = parseShardList(response["shards"])
+		shardMap, err := run(ctx, "admin", bson.D{{Key: "getShardMap", Value: 1}})
+		if err != nil {
+			return nil, nil, fmt.Errorf("run getShardMap on mongos at %q: %w", l.Config.Address, err)
+		}
+		if host, ok := bsonDocument(shardMap["map"])[configShardName].(string); ok {
+			shards = appendShard(shards, shardHost{Name: configShardName, Host: host})
+		}
+	case hello["configsvr"] != nil:
+		response, err := run(ctx, "config", bson.D{{Key: "find", Value: "shards"}})
+		if err != nil {
+			return nil, nil, fmt.Errorf("read config.shards on config server at %q: %w", l.Config.Address, err)
+		}
+		shards = parseShardList(bsonDocument(response["cursor"])["firstBatch"])
+		self.Name = configShardName
+		shards = appendShard(shards, self)
+	case setName != "":
+		return []shardHost{self}, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("mongo at %q is neither a mongos router nor a replica set member", l.Config.Address)
+	}
+
+	response, err := run(ctx, "config", bson.D{
+		{Key: "find", Value: "mongos"},
+		{Key: "filter", Value: bson.D{{Key: "ping", Value: bson.D{{Key: "$gte", Value: time.Now().Add(-mongosActiveWindow)}}}}},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("read config.mongos on mongo at %q: %w", l.Config.Address, err)
+	}
+	return shards, parseMongosList(bsonDocument(response["cursor"])["firstBatch"], hosts), nil
+}
+
+// runCommand runs command on database through the MONGO_URI client. Cursor
+// results are only read from the first batch, which holds 101 documents:
+// far more shards and routers than a cluster has.
+func (l *Labeler) runCommand(ctx context.Context, database string, command bson.D) (bson.M, error) {
+	client, err := l.connectMongo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var response bson.M
+	if err := client.Database(database).RunCommand(ctx, command).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// fetchShardTopology reads the primary, and with REPLICATION_LAG_THRESHOLD the
+// lag, of one shard replica set.
+func (l *Labeler) fetchShardTopology(ctx context.Context, shard shardHost, hosts hostMapper) (*topology, error) {
+	client, err := l.shardClient(shard)
+	if err != nil {
+		return nil, err
+	}
+	hello, err := runAdminCommand(ctx, client, "hello")
+	if err != nil {
+		return nil, fmt.Errorf("run hello command on %q: %w", shard.Host, err)
+	}
+	if l.Config.QuorumCheck {
+		hello, err = l.confirmPrimary(ctx, hello, func(ctx context.Context) (bson.M, error) {
+			return runAdminCommand(ctx, client, "replSetGetConfig")
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	top, err := parseTopology(hello, hosts)
+	if err != nil {
+		return nil, err
+	}
+	top.Shard = shard.Name
+	l.resolveMemberRoles(ctx, top, hosts, func(ctx context.Context) (bson.M, error) {
+		return runAdminCommand(ctx, client, "replSetGetConfig")
+	})
+	if l.Config.ReplicationLagThreshold > 0 {
+		l.resolveLag(ctx, top, hosts, func(ctx context.Context) (bson.M, error) {
+			return runAdminCommand(ctx, client, "replSetGetStatus")
+		})
+	}
+	return top, nil
+}
+
+// shardClient returns the long-lived client of a shard replica set, connecting
+// it on first use with the credentials and TLS settings of MONGO_URI.
+func (l *Labeler) shardClient(shard shardHost) (*mongo.Client, error) {
+	setName, hosts, err := shard.replicaSet()
+	if err != nil {
+		return nil, err
+	}
+	client, err := l.shardClients.get(shard.Host, func() (*options.ClientOptions, error) {
+		clientOptions, err := l.hostClientOptions(hosts)
+		if err != nil {
+			return nil, err
+		}
+		return clientOptions.SetReplicaSet(setName), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to shard %q at %q: %w", shard.Name, shard.Host, err)
+	}
+	return client, nil
+}
+
+// parseShardList converts listShards or config.shards documents to shards,
+// sorted by name.
+func parseShardList(value any) []shardHost {
+	documents, _ := value.(bson.A)
+	var shards []shardHost
+	for _, document := range documents {
+		doc := bsonDocument(document)
+		name, _ := doc["_id"].(string)
+		host, _ := doc["host"].(string)
+		if name == "" || host == "" {
+			continue
+		}
+		shards = append(shards, shardHost{Name: name, Host: host})
+	}
+	slices.SortFunc(shards, func(a, b shardHost) int { return strings.Compare(a.Name, b.Name) })
+	return shards
+}
+
+// parseMongosList returns the pod names of config.mongos documents, whose
+// _id is the router's "host:port".
+func parseMongosList(value any, hosts hostMapper) []string {
+	documents, _ := value.(bson.A)
+	var pods []string
+	for _, document := range documents {
+		id, _ := bsonDocument(document)["_id"].(string)
+		if podName := hosts(id); podName != "" {
+			pods = append(pods, podName)
+		}
+	}
+	slices.Sort(pods)
+	return pods
+}
+
+// appendShard adds shard unless one with the same name is listed already: from
+// MongoDB 8.0 the config servers can also act as the "config" shard.
+func appendShard(shards []shardHost, shard shardHost) []shardHost {
+	if slices.ContainsFunc(shards, func(s shardHost) bool { return s.Name == shard.Name }) {
+		return shards
+	}
+	return append(shards, shard)
+}
+
+// shardError prefixes err with the shard name, if any.
+func shardError(shard string, err error) error {
+	if shard == "" {
+		return err
+	}
+	return fmt.Errorf("shard %q: %w", shard, err)
+}
+
+// withShard adds the shard name, if any, to a log entry.
+func withShard(entry *phuslog.Entry, shard string) *phuslog.Entry {
+	if shard == "" {
+		return entry
+	}
+	return entry.Str("shard", shard)
+}
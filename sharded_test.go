@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeCommands answers the commands of discoverShards by database and name.
+func fakeCommands(responses map[string]bson.M) func(context.Context, string, bson.D) (bson.M, error) {
+	return func(_ context.Context, database string, command bson.D) (bson.M, error) {
+		key := fmt.Sprintf("%s.%s", database, command[0].Key)
+		if value, ok := command[0].Value.(string); ok {
+			key += "." + value
+		}
+		response, ok := responses[key]
+		if !ok {
+			return nil, fmt.Errorf("unexpected command %s", key)
+		}
+		return response, nil
+	}
+}
+
+func cursor(documents ...bson.D) bson.M {
+	batch := bson.A{}
+	for _, document := range documents {
+		batch = append(batch, document)
+	}
+	return bson.M{"cursor": bson.D{{Key: "firstBatch", Value: batch}, {Key: "id", Value: int64(0)}}}
+}
+
+func TestParseShardList(t *testing.T) {
+	shards := parseShardList(bson.A{
+		bson.D{{Key: "_id", Value: "shard1"}, {Key: "host", Value: "shard1/shard1-0.shard1:27018,shard1-1.shard1:27018"}},
+		bson.D{{Key: "_id", Value: "shard0"}, {Key: "host", Value: "shard0/shard0-0.shard0:27018"}},
+		bson.D{{Key: "_id", Value: "broken"}},
+	})
+	assert.Equal(t, []shardHost{
+		{Name: "shard0", Host: "shard0/shard0-0.shard0:27018"},
+		{Name: "shard1", Host: "shard1/shard1-0.shard1:27018,shard1-1.shard1:27018"},
+	}, shards)
+	assert.Equal(t, []string{"shard1-0", "shard1-1"}, shards[1].podNames(podNameFromHost))
+
+	_, _, err := shardHost{Name: "standalone", Host: "mongo-0:27018"}.replicaSet()
+	require.ErrorContains(t, err, "is not a replica set")
+}
+
+func TestDiscoverShards(t *testing.T) {
+	mongos := cursor(
+		bson.D{{Key: "_id", Value: "mongos-1:27017"}},
+		bson.D{{Key: "_id", Value: "mongos-0:27017"}},
+	)
+	tests := []struct {
+		name       string
+		hello      bson.M
+		responses  map[string]bson.M
+		wantShards []shardHost
+		wantMongos []string
+		wantErr    string
+	}{
+		{
+			name:  "through mongos",
+			hello: bson.M{"msg": "isdbgrid"},
+			responses: map[string]bson.M{
+				"admin.listShards": {"shards": bson.A{
+					bson.D{{Key: "_id", Value: "shard0"}, {Key: "host", Value: "shard0/shard0-0.shard0:27018"}},
+				}},
+				"admin.getShardMap": {"map": bson.D{
+					{Key: "shard0", Value: "shard0/shard0-0.shard0:27018"},
+					{Key: "config", Value: "cfg/cfg-0.cfg:27019"},
+				}},
+				"config.find.mongos": mongos,
+			},
+			wantShards: []shardHost{
+				{Name: "shard0", Host: "shard0/shard0-0.shard0:27018"},
+				{Name: "config", Host: "cfg/cfg-0.cfg:27019"},
+			},
+			wantMongos: []string{"mongos-0", "mongos-1"},
+		},
+		{
+			name:  "through a config server",
+			hello: bson.M{"setName": "cfg", "configsvr": int32(2), "hosts": bson.A{"cfg-0.cfg:27019", "cfg-1.cfg:27019"}},
+			responses: map[string]bson.M{
+				"config.find.shards": cursor(
+					bson.D{{Key: "_id", Value: "shard0"}, {Key: "host", Value: "shard0/shard0-0.shard0:27018"}},
+				),
+				"config.find.mongos": mongos,
+			},
+			wantShards: []shardHost{
+				{Name: "shard0", Host: "shard0/shard0-0.shard0:27018"},
+				{Name: "config", Host: "cfg/cfg-0.cfg:27019,cfg-1.cfg:27019"},
+			},
+			wantMongos: []string{"mongos-0", "mongos-1"},
+		},
+		{
+			name:       "through a shard member",
+			hello:      bson.M{"setName": "shard0", "hosts": bson.A{"shard0-0.shard0:27018"}},
+			wantShards: []shardHost{{Name: "shard0", Host: "shard0/shard0-0.shard0:27018"}},
+		},
+		{
+			name:    "standalone",
+			hello:   bson.M{"isWritablePrimary": true},
+			wantErr: "neither a mongos router nor a replica set member",
+		},
+		{
+			name:    "listShards fails",
+			hello:   bson.M{"msg": "isdbgrid"},
+			wantErr: "run listShards on mongos",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Labeler{Config: &Config{Address: "mongos:27017"}, commandRunner: fakeCommands(tt.responses)}
+			shards, mongos, err := l.discoverShards(context.Background(), tt.hello, podNameFromHost)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantShards, shards)
+			assert.Equal(t, tt.wantMongos, mongos)
+		})
+	}
+}
+
+func TestGetClusterTopology_ResolvesShardsIndependently(t *testing.T) {
+	l := &Labeler{
+		Config: &Config{Address: "mongos:27017", Sharded: true},
+		helloFetcher: func(context.Context) (bson.M, error) {
+			return bson.M{"msg": "isdbgrid"}, nil
+		},
+		commandRunner: fakeCommands(map[string]bson.M{
+			"admin.listShards": {"shards": bson.A{
+				bson.D{{Key: "_id", Value: "shard0"}, {Key: "host", Value: "shard0/shard0-0.shard0:27018"}},
+				bson.D{{Key: "_id", Value: "shard1"}, {Key: "host", Value: "shard1/shard1-0.shard1:27018,shard1-1.shard1:27018"}},
+			}},
+			"admin.getShardMap":  {"map": bson.M{}},
+			"config.find.mongos": cursor(bson.D{{Key: "_id", Value: "mongos-0:27017"}}),
+		}),
+		shardResolver: func(_ context.Context, shard shardHost, _ hostMapper) (*topology, error) {
+			if shard.Name == "shard1" {
+				return nil, errors.New("server selection timeout")
+			}
+			return &topology{Primary: "shard0-0", Roles: map[string]string{"shard0-0": rolePrimary}}, nil
+		},
+	}
+
+	c, err := l.getClusterTopology()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mongos-0"}, c.Mongos)
+	require.Len(t, c.ReplicaSets, 2)
+	assert.Equal(t, &topology{Shard: "shard0", Primary: "shard0-0", Roles: map[string]string{"shard0-0": rolePrimary}}, c.ReplicaSets[0])
+	assert.Equal(t, &topology{Shard: "shard1", Roles: map[string]string{"shard1-0": roleUnknown, "shard1-1": roleUnknown}}, c.ReplicaSets[1])
+	require.Len(t, c.Errors, 1)
+	assert.EqualError(t, c.Errors[0], `shard "shard1": server selection timeout`)
+}
+
+func TestGetMongoTopology_RejectsMongosOutsideShardedMode(t *testing.T) {
+	l := &Labeler{
+		Config: &Config{Address: "mongos:27017"},
+		helloFetcher: func(context.Context) (bson.M, error) {
+			return bson.M{"msg": "isdbgrid"}, nil
+		},
+	}
+	_, err := l.getMongoTopology()
+	require.ErrorContains(t, err, "set SHARDED=true")
+}
+
+func TestSetPrimaryLabel_Sharded(t *testing.T) {
+	pods := []runtime.Object{}
+	for _, name := range []string{"shard0-0", "shard0-1", "shard1-0", "shard1-1", "cfg-0", "mongos-0", "stray-0"} {
+		pods = append(pods, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{"role": "mongo"},
+		}})
+	}
+	// shard1 could not be resolved; its pods keep their labels.
+	pods = append(pods, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:      "shard2-0",
+		Namespace: "default",
+		Labels:    map[string]string{"role": "mongo", "primary": "true", shardLabel: "shard2", roleLabel: rolePrimary},
+	}})
+	k8sClient := fake.NewClientset(pods...)
+
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.Config.Sharded = true
+	labeler.clusterResolver = func() (*cluster, error) {
+		return &cluster{
+			ReplicaSets: []*topology{
+				{Shard: "shard0", Primary: "shard0-1", Roles: map[string]string{"shard0-0": roleSecondary, "shard0-1": rolePrimary}},
+				{Shard: "shard1", Primary: "shard1-0", Roles: map[string]string{"shard1-0": rolePrimary, "shard1-1": roleSecondary}},
+				{Shard: configShardName, Primary: "cfg-0", Roles: map[string]string{"cfg-0": rolePrimary}},
+				{Shard: "shard2", Roles: map[string]string{"shard2-0": roleUnknown}},
+			},
+			Mongos: []string{"mongos-0"},
+			Errors: []error{errors.New(`shard "shard2": server selection timeout`)},
+		}, nil
+	}
+
+	err := labeler.setPrimaryLabel()
+	require.ErrorContains(t, err, "shard2")
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, map[string]map[string]string{
+		"shard0-0": {"role": "mongo", "primary": "false", shardLabel: "shard0", roleLabel: roleSecondary},
+		"shard0-1": {"role": "mongo", "primary": "true", shardLabel: "shard0", roleLabel: rolePrimary},
+		"shard1-0": {"role": "mongo", "primary": "true", shardLabel: "shard1", roleLabel: rolePrimary},
+		"shard1-1": {"role": "mongo", "primary": "false", shardLabel: "shard1", roleLabel: roleSecondary},
+		"cfg-0":    {"role": "mongo", "primary": "true", shardLabel: configShardName, roleLabel: rolePrimary},
+		"mongos-0": {"role": "mongo", "primary": "false", roleLabel: roleMongos},
+		"stray-0":  {"role": "mongo"},
+		"shard2-0": {"role": "mongo", "primary": "true", shardLabel: "shard2", roleLabel: rolePrimary},
+	}, labels)
+	assert.Equal(t, map[string]string{"shard0": "shard0-1", "shard1": "shard1-0", configShardName: "cfg-0"}, labeler.lastPrimary)
+}
+
+func TestSetPrimaryLabel_ShardMembersShareSelector(t *testing.T) {
+	k8sClient := fake.NewClientset()
+	for _, pod := range []*corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "shard0-0", Namespace: "default", Labels: map[string]string{"role": "mongo"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "shard0-1", Namespace: "default", Labels: map[string]string{"role": "mongo"}}},
+		{ObjectMeta: metav1.ObjectMeta{
+			Name:      "shard1-0",
+			Namespace: "default",
+			Labels:    map[string]string{"role": "mongo", "primary": "true", shardLabel: "shard1", roleLabel: rolePrimary},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{
+			Name:      "shard1-1",
+			Namespace: "default",
+			Labels:    map[string]string{"role": "mongo", "primary": "false", shardLabel: "shard1", roleLabel: roleSecondary},
+		}},
+	} {
+		_, err := k8sClient.CoreV1().Pods("default").Create(context.Background(), pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	// A sidecar in shard0 sees only its own replica set; shard1 belongs to the
+	// sidecar running there.
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.Config.Sharded = true
+	labeler.helloFetcher = func(context.Context) (bson.M, error) {
+		return bson.M{"setName": "shard0", "hosts": bson.A{"shard0-0.shard0:27018", "shard0-1.shard0:27018"}}, nil
+	}
+	labeler.shardResolver = func(_ context.Context, shard shardHost, _ hostMapper) (*topology, error) {
+		return &topology{Primary: "shard0-0", Roles: map[string]string{"shard0-0": rolePrimary, "shard0-1": roleSecondary}}, nil
+	}
+
+	require.NoError(t, labeler.setPrimaryLabel())
+	labels, _ := podMetadata(t, k8sClient)
+	assert.Equal(t, map[string]map[string]string{
+		"shard0-0": {"role": "mongo", "primary": "true", shardLabel: "shard0", roleLabel: rolePrimary},
+		"shard0-1": {"role": "mongo", "primary": "false", shardLabel: "shard0", roleLabel: roleSecondary},
+		"shard1-0": {"role": "mongo", "primary": "true", shardLabel: "shard1", roleLabel: rolePrimary},
+		"shard1-1": {"role": "mongo", "primary": "false", shardLabel: "shard1", roleLabel: roleSecondary},
+	}, labels)
+}
+
+func TestSetPrimaryLabel_ShardedPrimaryNotFoundOnlySkipsThatShard(t *testing.T) {
+	k8sClient := newMongoClientset("default", "shard0-0", "shard1-0")
+	labeler := newTestLabeler(k8sClient, true, "")
+	labeler.Config.Sharded = true
+	labeler.clusterResolver = func() (*cluster, error) {
+		return &cluster{ReplicaSets: []*topology{
+			{Shard: "shard0", Primary: "shard0-0", Roles: map[string]string{"shard0-0": rolePrimary}},
+			{Shard: "shard1", Primary: "shard1-9", Roles: map[string]string{"shard1-0": roleSecondary, "shard1-9": rolePrimary}},
+		}}, nil
+	}
+
+	err := labeler.setPrimaryLabel()
+	require.ErrorIs(t, err, errPrimaryNotFound)
+	require.ErrorContains(t, err, `shard "shard1"`)
+	assert.Equal(t, map[string]any{"shard0-0": "true"}, collectPrimaryPatchValues(t, k8sClient))
+}
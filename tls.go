@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	phuslog "github.com/phuslu/log"
+)
+
+// MongoTLS is the optional TLS configuration for the MongoDB connection.
+type MongoTLS struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// getMongoTLSFromEnvironment reads MONGO_TLS, MONGO_TLS_CA_FILE,
+// MONGO_TLS_CERT_FILE, MONGO_TLS_KEY_FILE and MONGO_TLS_INSECURE_SKIP_VERIFY.
+// Setting any of the files enables TLS. The files are loaded once here so a
+// bad path or PEM fails startup instead of every reconcile.
+func getMongoTLSFromEnvironment() (MongoTLS, error) {
+	enabled, err := envBool("MONGO_TLS", false)
+	if err != nil {
+		return MongoTLS{}, err
+	}
+	insecure, err := envBool("MONGO_TLS_INSECURE_SKIP_VERIFY", false)
+	if err != nil {
+		return MongoTLS{}, err
+	}
+	cfg := MongoTLS{
+		CAFile:             envString("MONGO_TLS_CA_FILE", ""),
+		CertFile:           envString("MONGO_TLS_CERT_FILE", ""),
+		KeyFile:            envString("MONGO_TLS_KEY_FILE", ""),
+		InsecureSkipVerify: insecure,
+	}
+	cfg.Enabled = enabled || insecure || cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != ""
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return MongoTLS{}, fmt.Errorf("MONGO_TLS_CERT_FILE and MONGO_TLS_KEY_FILE must be set together")
+	}
+	if cfg.Enabled {
+		if err := newTLSFiles(cfg).reload(); err != nil {
+			return MongoTLS{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// tlsFiles serves the CA pool and client certificate from disk, re-reading a
+// file whenever its modification time or size changes. cert-manager rotates
+// Secret volumes in place: a rotated client certificate is picked up by the
+// next handshake, and a rotated CA pool by reconnectOnCARotation, which
+// rebuilds the MongoDB clients. Established connections keep the old material
+// until the driver replaces them.
+type tlsFiles struct {
+	cfg MongoTLS
+
+	mu        sync.Mutex
+	loaded    bool
+	caStamp   fileStamp
+	certStamp [2]fileStamp
+	roots     *x509.CertPool
+	cert      *tls.Certificate
+}
+
+// fileStamp identifies one version of a file on disk.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newTLSFiles(cfg MongoTLS) *tlsFiles {
+	return &tlsFiles{cfg: cfg}
+}
+
+// tlsConfig returns a config verifying the server against the CA pool loaded
+// when it is built, with the client certificate resolved per handshake. The
+// driver sets ServerName to the dialed host, so Go checks the certificate
+// against the member's DNS name or IP address.
+func (f *tlsFiles) tlsConfig() *tls.Config {
+	f.mu.Lock()
+	roots := f.roots
+	f.mu.Unlock()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// A nil RootCAs pool means the system roots, used when no CA file is set.
+		RootCAs:            roots,
+		InsecureSkipVerify: f.cfg.InsecureSkipVerify, // #nosec G402 -- MONGO_TLS_INSECURE_SKIP_VERIFY, for debugging only
+	}
+	if f.cfg.CertFile != "" {
+		config.GetClientCertificate = f.clientCertificate
+	}
+	return config
+}
+
+func (f *tlsFiles) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, cert, err := f.current()
+	return cert, err
+}
+
+// current reloads changed files and returns the CA pool and client certificate
+// to use. If a reload fails after files were loaded successfully once, the
+// previous material is kept and a warning logged, so a half-written rotation
+// does not break new connections.
+func (f *tlsFiles) current() (*x509.CertPool, *tls.Certificate, error) {
+	err := f.reload()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		if !f.loaded {
+			return nil, nil, err
+		}
+		phuslog.Warn().Err(err).Msg("failed to reload mongo TLS files, keeping the previous ones")
+	}
+	return f.roots, f.cert, nil
+}
+
+// reload re-reads whichever files changed since the last call.
+func (f *tlsFiles) reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cfg.CAFile != "" {
+		stamp, err := statFile(f.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("stat MONGO_TLS_CA_FILE: %w", err)
+		}
+		if stamp != f.caStamp {
+			pem, err := os.ReadFile(f.cfg.CAFile) // #nosec G304 -- path comes from operator configuration
+			if err != nil {
+				return fmt.Errorf("read MONGO_TLS_CA_FILE: %w", err)
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in MONGO_TLS_CA_FILE %q", f.cfg.CAFile)
+			}
+			f.roots, f.caStamp = roots, stamp
+		}
+	}
+
+	if f.cfg.CertFile != "" {
+		certStamp, err := statFile(f.cfg.CertFile)
+		if err != nil {
+			return fmt.Errorf("stat MONGO_TLS_CERT_FILE: %w", err)
+		}
+		keyStamp, err := statFile(f.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("stat MONGO_TLS_KEY_FILE: %w", err)
+		}
+		stamps := [2]fileStamp{certStamp, keyStamp}
+		if stamps != f.certStamp {
+			cert, err := tls.LoadX509KeyPair(f.cfg.CertFile, f.cfg.KeyFile)
+			if err != nil {
+				return fmt.Errorf("load mongo client certificate: %w", err)
+			}
+			f.cert, f.certStamp = &cert, stamps
+		}
+	}
+	f.loaded = true
+	return nil
+}
+
+// reconnectOnCARotation drops every MongoDB client once MONGO_TLS_CA_FILE has
+// changed since they were built, so they reconnect verifying against the new
+// CA pool. It runs before each reconcile connects.
+func (l *Labeler) reconnectOnCARotation(ctx context.Context) {
+	if l.tlsFiles == nil {
+		return
+	}
+	roots, _, err := l.tlsFiles.current()
+	if err != nil || roots == l.tlsRoots {
+		return
+	}
+	if l.tlsRoots != nil {
+		withReplicaSet(phuslog.Info(), l.Config.Name).Msg("MONGO_TLS_CA_FILE changed, reconnecting to mongo")
+		l.closeMongo(ctx)
+	}
+	l.tlsRoots = roots
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
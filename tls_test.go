@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// testCert is a certificate and key generated for a test, optionally signed by
+// a parent.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, commonName string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(commonName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{commonName}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate (and key, when keyPath is set) and bumps the
+// modification time so a rewrite is always detected as a change.
+func (c *testCert) writePEM(t *testing.T, certPath, keyPath string, modTime time.Time) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600))
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	if keyPath != "" {
+		keyDER, err := x509.MarshalECPrivateKey(c.key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+		require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+	}
+}
+
+// handshake runs a TLS handshake between config and a server presenting
+// server, with ServerName set to host as the driver does.
+func handshake(t *testing.T, config *tls.Config, host string, server *testCert) error {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}}}
+		_ = tls.Server(serverConn, serverConfig).Handshake()
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	config = config.Clone()
+	config.ServerName = host
+	err = tls.Client(clientConn, config).Handshake()
+	clientConn.Close()
+	<-done
+	return err
+}
+
+func TestTLSFiles_VerifiesServerHost(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	ca := newTestCert(t, "ca", true, nil)
+	ca.writePEM(t, caFile, "", time.Now())
+	files := newTLSFiles(MongoTLS{Enabled: true, CAFile: caFile})
+	require.NoError(t, files.reload())
+	config := files.tlsConfig()
+
+	tests := []struct {
+		name    string
+		host    string
+		cert    string
+		wantErr string
+	}{
+		{name: "DNS name", host: "mongo-0.mongo", cert: "mongo-0.mongo"},
+		{name: "other DNS name", host: "mongo-1.mongo", cert: "mongo-0.mongo", wantErr: "valid for mongo-0.mongo, not mongo-1.mongo"},
+		{name: "IP address", host: "10.0.0.1", cert: "10.0.0.1"},
+		{name: "other IP address", host: "10.0.0.1", cert: "10.0.0.2", wantErr: "valid for 10.0.0.2, not 10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshake(t, config, tt.host, newTestCert(t, tt.cert, false, ca))
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	// A certificate from another CA is rejected, unless
+	// MONGO_TLS_INSECURE_SKIP_VERIFY is set.
+	other := newTestCert(t, "mongo-0.mongo", false, newTestCert(t, "other-ca", true, nil))
+	require.ErrorContains(t, handshake(t, config, "mongo-0.mongo", other), "certificate signed by unknown authority")
+	insecure := newTLSFiles(MongoTLS{Enabled: true, InsecureSkipVerify: true})
+	require.NoError(t, handshake(t, insecure.tlsConfig(), "mongo-0.mongo", other))
+}
+
+func TestReconnectOnCARotation(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	oldCA := newTestCert(t, "old-ca", true, nil)
+	newCA := newTestCert(t, "new-ca", true, nil)
+	oldCA.writePEM(t, caFile, "", time.Now().Add(-time.Minute))
+
+	labeler := &Labeler{Config: &Config{}, tlsFiles: newTLSFiles(MongoTLS{Enabled: true, CAFile: caFile})}
+	labeler.reconnectOnCARotation(context.Background())
+	client, err := mongo.Connect(options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	require.NoError(t, err)
+	labeler.mongoClient = client
+
+	labeler.reconnectOnCARotation(context.Background())
+	assert.Same(t, client, labeler.mongoClient, "the client is kept while the CA file is unchanged")
+
+	newCA.writePEM(t, caFile, "", time.Now())
+	labeler.reconnectOnCARotation(context.Background())
+	assert.Nil(t, labeler.mongoClient, "the client is rebuilt after the CA file changed")
+
+	server := newTestCert(t, "mongo-0.mongo", false, newCA)
+	require.NoError(t, handshake(t, labeler.tlsFiles.tlsConfig(), "mongo-0.mongo", server), "new clients trust the rotated CA")
+}
+
+func TestTLSFiles_ClientCertificateReloads(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	first := newTestCert(t, "labeler", false, nil)
+	first.writePEM(t, certFile, keyFile, time.Now().Add(-time.Minute))
+
+	files := newTLSFiles(MongoTLS{Enabled: true, CertFile: certFile, KeyFile: keyFile})
+	config := files.tlsConfig()
+	require.NotNil(t, config.GetClientCertificate)
+
+	got, err := config.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, first.der, got.Certificate[0])
+
+	second := newTestCert(t, "labeler", false, nil)
+	second.writePEM(t, certFile, keyFile, time.Now())
+	got, err = config.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, second.der, got.Certificate[0])
+
+	// A half-written rotation keeps serving the last good certificate.
+	require.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0o600))
+	require.ErrorContains(t, files.reload(), "load mongo client certificate")
+	got, err = config.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, second.der, got.Certificate[0])
+}
+
+func TestGetMongoTLSFromEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	newTestCert(t, "ca", true, nil).writePEM(t, caFile, "", time.Now())
+	emptyFile := filepath.Join(dir, "empty.crt")
+	require.NoError(t, os.WriteFile(emptyFile, nil, 0o600))
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		want        MongoTLS
+		errContains string
+	}{
+		{
+			name: "disabled by default",
+			env:  map[string]string{},
+			want: MongoTLS{},
+		},
+		{
+			name: "CA file enables TLS",
+			env:  map[string]string{"MONGO_TLS_CA_FILE": caFile},
+			want: MongoTLS{Enabled: true, CAFile: caFile},
+		},
+		{
+			name: "system roots",
+			env:  map[string]string{"MONGO_TLS": "true"},
+			want: MongoTLS{Enabled: true},
+		},
+		{
+			name:        "cert without key",
+			env:         map[string]string{"MONGO_TLS_CERT_FILE": caFile},
+			errContains: "must be set together",
+		},
+		{
+			name:        "CA file without certificates",
+			env:         map[string]string{"MONGO_TLS_CA_FILE": emptyFile},
+			errContains: "no certificates found in MONGO_TLS_CA_FILE",
+		},
+		{
+			name:        "missing CA file",
+			env:         map[string]string{"MONGO_TLS_CA_FILE": filepath.Join(dir, "missing")},
+			errContains: "stat MONGO_TLS_CA_FILE",
+		},
+		{
+			name:        "invalid MONGO_TLS_INSECURE_SKIP_VERIFY",
+			env:         map[string]string{"MONGO_TLS_INSECURE_SKIP_VERIFY": "maybe"},
+			errContains: "invalid MONGO_TLS_INSECURE_SKIP_VERIFY value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfigEnv(t, tt.env)
+
+			got, err := getMongoTLSFromEnvironment()
+			if tt.errContains != "" {
+				require.ErrorContains(t, err, tt.errContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}